@@ -0,0 +1,170 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Suffix of the local thumbnail of an item, next to its .strm
+const thumbSuffix = "-thumb.jpg"
+
+// Content addressed cache of downloaded artwork under the state directory.
+// Images are stored by the hash of their content, and each url refers to the
+// image it was last downloaded as, so an image is fetched once per url and
+// stored once however many urls it is found at.
+//
+//	artwork/urls/<sha1 of url>      hash of the image content
+//	artwork/images/<sha256>         the image
+func artworkDir() string {
+	return filepath.Join(stateDir, "artwork")
+}
+
+var artworkLocks keyedMutex
+
+func artworkUrlFile(url string) string {
+	sum := sha1.Sum([]byte(url))
+	return filepath.Join(artworkDir(), "urls", hex.EncodeToString(sum[:]))
+}
+
+func artworkImageFile(hash string) string {
+	return filepath.Join(artworkDir(), "images", hash)
+}
+
+// The image at the url, from the cache or downloaded
+func fetchArtwork(url string) ([]byte, error) {
+	defer artworkLocks.lock(url)()
+
+	urlFile := artworkUrlFile(url)
+	if hash, err := os.ReadFile(urlFile); err == nil {
+		data, err := os.ReadFile(artworkImageFile(strings.TrimSpace(string(hash))))
+		if err == nil {
+			return data, nil
+		}
+	}
+
+	slog.Debug("Downloading artwork", "url", url)
+	resp, err := client.fetch(url, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.body) == 0 {
+		return nil, errors.New("empty image")
+	}
+	if planning {
+		return resp.body, nil
+	}
+
+	sum := sha256.Sum256(resp.body)
+	hash := hex.EncodeToString(sum[:])
+	imageFile := artworkImageFile(hash)
+	if _, err := os.Stat(imageFile); errors.Is(err, fs.ErrNotExist) {
+		err = writeStateFile(imageFile, resp.body)
+		if err != nil {
+			slog.Error("Could not cache artwork", "url", url, "error", err)
+			return resp.body, nil
+		}
+	}
+	err = writeStateFile(urlFile, []byte(hash+"\n"))
+	if err != nil {
+		slog.Error("Could not cache artwork", "url", url, "error", err)
+	}
+	return resp.body, nil
+}
+
+// Write a file under the state directory atomically, creating its directory
+func writeStateFile(file string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return replaceFile(file, data)
+}
+
+// Download the thumbnail of an item next to its .strm. Returns the name of
+// the thumbnail, relative to the playlist directory, as referenced in the nfo.
+func writeThumb(dir, title string, item PlaylistItem) (string, error) {
+	data, err := fetchArtwork(item.iconUrl)
+	if err != nil {
+		return "", err
+	}
+	name := title + thumbSuffix
+	err = output.WriteFile(dir+name, data, item.time)
+	if err != nil {
+		return "", err
+	}
+	produced.addFile(dir + name)
+	return name, nil
+}
+
+// Keep the local thumbnail of an item as it is, when it can not be refreshed
+func keepThumb(dir, title string) (string, bool) {
+	name := title + thumbSuffix
+	_, err := output.ModTime(dir + name)
+	if err != nil {
+		return "", false
+	}
+	produced.addFile(dir + name)
+	return name, true
+}
+
+// Folder artwork of a playlist directory
+const (
+	posterFile = "poster.jpg"
+	fanartFile = "fanart.jpg"
+	bannerFile = "banner.jpg"
+)
+
+// The folder artwork of a feed, from the first source that has artwork for
+// it, or else the feed image as poster
+func folderArtwork(info PlaylistInfo) FolderArtwork {
+	for _, source := range sources {
+		if artworkSource, ok := source.(ArtworkSource); ok {
+			if artwork, ok := artworkSource.Artwork(info.feedUrl, info); ok {
+				return artwork
+			}
+		}
+	}
+	return FolderArtwork{poster: info.imageUrl}
+}
+
+// Write the poster, fanart and banner of a playlist directory. Images are
+// only downloaded when their url changes, artwork that can not be downloaded
+// is kept as it is. Returns whether the directory has a poster.
+func writeFolderArtwork(dir string, info PlaylistInfo) bool {
+	artwork := folderArtwork(info)
+	poster := false
+	for _, file := range []struct{ name, url string }{
+		{posterFile, artwork.poster},
+		{fanartFile, artwork.fanart},
+		{bannerFile, artwork.banner},
+	} {
+		if len(file.url) == 0 {
+			continue
+		}
+		data, err := fetchArtwork(file.url)
+		if err != nil {
+			slog.Warn("Could not download folder artwork", "directory", dir, "file", file.name, "url", file.url, "error", err)
+			if _, err := output.ModTime(dir + file.name); err == nil {
+				produced.addFile(dir + file.name)
+				poster = poster || file.name == posterFile
+			}
+			continue
+		}
+		err = output.WriteFile(dir+file.name, data, time.Unix(1, 0))
+		if err != nil {
+			slog.Error("Could not write folder artwork", "file", dir+file.name, "error", err)
+			continue
+		}
+		produced.addFile(dir + file.name)
+		poster = poster || file.name == posterFile
+	}
+	return poster
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+// On disk cache of the ETag and Last-Modified validators of fetched urls,
+// used to make conditional requests. Pages are cached with their body, so
+// that a 304 response can be answered from the cache. Feeds are cached
+// without body, a 304 response means the feed can be skipped entirely.
+type httpCache struct {
+	dir string
+}
+
+type cacheEntry struct {
+	Key          string `json:"Key"`
+	Url          string `json:"Url"`
+	ETag         string `json:"ETag,omitempty"`
+	LastModified string `json:"LastModified,omitempty"`
+	Body         []byte `json:"Body,omitempty"`
+	// Playlists that the items of the feed refer to, written again when the
+	// feed is not modified
+	Recursions []Recursion `json:"Recursions,omitempty"`
+}
+
+// A playlist that an item refers to, such as a program of an SVT category
+type Recursion struct {
+	Title string `json:"Title"`
+	Url   string `json:"Url"`
+}
+
+// The cache, nil if disabled
+var cache *httpCache
+
+func (c *httpCache) file(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".json")
+}
+
+func (c *httpCache) load(key string) *cacheEntry {
+	if c == nil {
+		return nil
+	}
+	data, err := os.ReadFile(c.file(key))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	err = json.Unmarshal(data, entry)
+	if err != nil || entry.Key != key {
+		slog.Warn("Ignoring invalid cache entry", "key", key, "error", err)
+		return nil
+	}
+	return entry
+}
+
+func (c *httpCache) store(entry *cacheEntry) {
+	if c == nil || planning {
+		return
+	}
+	if len(entry.ETag) == 0 && len(entry.LastModified) == 0 {
+		return
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		slog.Error("Could not encode cache entry", "url", entry.Url, "error", err)
+		return
+	}
+	err = writeStateFile(c.file(entry.Key), data)
+	if err != nil {
+		slog.Error("Could not write cache entry", "url", entry.Url, "error", err)
+	}
+}
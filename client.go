@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Client fetches all urls, feeds as well as pages. Requests are rate
+// limited per host and failed requests are retried with exponential backoff.
+// Servers asking to slow down with 429 or 503 are waited for as long as
+// their Retry-After header says.
+type Client struct {
+	http          *http.Client
+	retries       int
+	backoff       time.Duration
+	maxRetryAfter time.Duration
+	userAgent     string
+}
+
+// HTTPError is returned for responses with a non successful status
+type HTTPError struct {
+	Url        string
+	StatusCode int
+	Status     string
+}
+
+func (e HTTPError) Error() string {
+	return fmt.Sprintf("unexpected status %s for %s", e.Status, e.Url)
+}
+
+var client = newClient(10*time.Second, 30*time.Second, 3, time.Second)
+
+func newClient(connectTimeout, readTimeout time.Duration, retries int, backoff time.Duration) *Client {
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   connectTimeout,
+		ResponseHeaderTimeout: readTimeout,
+		MaxIdleConnsPerHost:   4,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	return &Client{
+		http: &http.Client{
+			Transport: transport,
+			// Bounds the whole request, including reading the body
+			Timeout: connectTimeout + readTimeout,
+		},
+		retries:       retries,
+		backoff:       backoff,
+		maxRetryAfter: 5 * time.Minute,
+		userAgent:     "plg (+https://github.com/claes/plg)",
+	}
+}
+
+// Response to a request
+type Response struct {
+	body        []byte
+	notModified bool
+	entry       *cacheEntry
+}
+
+// Store the validators of the response in the cache. Call when the response
+// has been processed, so that a failed run is not skipped as not modified in
+// the next run.
+func (r *Response) commit() {
+	cache.store(r.entry)
+}
+
+// Get the body of a page. Pages are cached with their body and answered from
+// the cache if the server responds that the page is not modified.
+func (c *Client) get(url string, header http.Header) ([]byte, error) {
+	cached := cache.load(url)
+	if cached != nil && cached.Body == nil {
+		cached = nil
+	}
+	resp, err := c.fetch(url, header, cached)
+	if err != nil {
+		return nil, err
+	}
+	if resp.notModified {
+		slog.Debug("Page not modified, using cached body", "url", url)
+		return cached.Body, nil
+	}
+	resp.entry.Key = url
+	resp.entry.Body = resp.body
+	resp.commit()
+	return resp.body, nil
+}
+
+// Get the url conditionally, using validators cached under the key. The
+// validators of the response are stored under the key by Response.commit.
+// A response that is not modified carries the cached entry.
+func (c *Client) getConditional(url string, key string) (*Response, error) {
+	cached := cache.load(key)
+	resp, err := c.fetch(url, nil, cached)
+	if err != nil {
+		return nil, err
+	}
+	if resp.notModified {
+		// What was recorded when the feed was last written still holds
+		resp.entry = cached
+	}
+	resp.entry.Key = key
+	return resp, nil
+}
+
+// Fetch the url, retrying on network errors, 429 and 5xx responses
+func (c *Client) fetch(url string, header http.Header, cached *cacheEntry) (*Response, error) {
+	header = header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	if cached != nil {
+		if len(cached.ETag) > 0 {
+			header.Set("If-None-Match", cached.ETag)
+		}
+		if len(cached.LastModified) > 0 {
+			header.Set("If-Modified-Since", cached.LastModified)
+		}
+	}
+
+	var err error
+	for attempt := 0; attempt <= c.retries; attempt++ {
+		var resp *Response
+		var wait time.Duration
+		resp, wait, err = c.attempt(url, header)
+		if err == nil {
+			if resp.notModified && cached == nil {
+				return nil, HTTPError{Url: url, StatusCode: http.StatusNotModified, Status: "304 Not Modified"}
+			}
+			return resp, nil
+		}
+		if wait < 0 || attempt == c.retries {
+			slog.Error("Request failed", "url", url, "attempt", attempt+1, "error", err)
+			break
+		}
+		if wait == 0 {
+			wait = c.backoff << attempt
+			wait += time.Duration(rand.Int63n(int64(wait)/2 + 1))
+		}
+		slog.Warn("Request failed, retrying", "url", url, "attempt", attempt+1, "retryIn", wait, "error", err)
+		time.Sleep(wait)
+	}
+	return nil, err
+}
+
+// A single request. The returned wait is negative if the request should not
+// be retried, positive if the server asked to wait and zero for the default
+// backoff.
+func (c *Client) attempt(url string, header http.Header) (*Response, time.Duration, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, -1, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if len(req.Header.Get("User-Agent")) == 0 {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+
+	limiter.wait(url)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+
+	entry := &cacheEntry{
+		Url:          url,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return &Response{notModified: true, entry: entry}, 0, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err = HTTPError{Url: url, StatusCode: resp.StatusCode, Status: resp.Status}
+		switch {
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable:
+			return nil, c.retryAfter(resp), err
+		case resp.StatusCode >= 500:
+			return nil, 0, err
+		default:
+			return nil, -1, err
+		}
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &Response{body: body, entry: entry}, 0, nil
+}
+
+// Parse the Retry-After header, given either in seconds or as a date
+func (c *Client) retryAfter(resp *http.Response) time.Duration {
+	retryAfter := resp.Header.Get("Retry-After")
+	if len(retryAfter) == 0 {
+		return 0
+	}
+	var wait time.Duration
+	if seconds, err := strconv.Atoi(retryAfter); err == nil {
+		wait = time.Duration(seconds) * time.Second
+	} else if t, err := http.ParseTime(retryAfter); err == nil {
+		wait = time.Until(t)
+	}
+	if wait <= 0 {
+		return 0
+	}
+	return min(wait, c.maxRetryAfter)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	url2 "net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Slots for concurrently running workers. Work is run in the calling
+// goroutine when all slots are taken, so that nested work, such as the
+// playlists of a channel, never waits for a slot held by its parent.
+var workerSlots chan struct{}
+
+func initWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	workerSlots = make(chan struct{}, workers-1)
+}
+
+// Run work in a worker if a slot is free, otherwise in the calling goroutine
+func runWorker(wg *sync.WaitGroup, work func()) {
+	wg.Add(1)
+	select {
+	case workerSlots <- struct{}{}:
+		go func() {
+			defer wg.Done()
+			defer func() { <-workerSlots }()
+			work()
+		}()
+	default:
+		defer wg.Done()
+		work()
+	}
+}
+
+// Mutexes by key, for example to serialize writes to the same directory
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*sync.Mutex)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		k.locks[key] = l
+	}
+	k.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+var dirLocks keyedMutex
+var historyLocks keyedMutex
+
+// Rate limiting of requests per host. A host is limited by the most specific
+// configured domain it belongs to, so www.youtube.com and m.youtube.com share
+// the limit of youtube.com. The default interval is the least interval for
+// every host, a configured domain can only make its interval longer.
+type hostLimiter struct {
+	mu              sync.Mutex
+	intervals       map[string]time.Duration
+	defaultInterval time.Duration
+	next            map[string]time.Time
+}
+
+var limiter = &hostLimiter{}
+
+// Parse host intervals such as youtube.com=2s,reddit.com=5s
+func parseHostIntervals(s string) (map[string]time.Duration, error) {
+	intervals := make(map[string]time.Duration)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		host, interval, found := strings.Cut(part, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid host interval %s, expected host=interval", part)
+		}
+		d, err := time.ParseDuration(interval)
+		if err != nil {
+			return nil, fmt.Errorf("invalid host interval %s: %w", part, err)
+		}
+		intervals[strings.ToLower(host)] = d
+	}
+	return intervals, nil
+}
+
+func (l *hostLimiter) domain(host string) (string, time.Duration) {
+	host = strings.ToLower(host)
+	best := ""
+	interval := l.defaultInterval
+	for domain, d := range l.intervals {
+		if (host == domain || strings.HasSuffix(host, "."+domain)) && len(domain) > len(best) {
+			best = domain
+			interval = d
+		}
+	}
+	if len(best) == 0 {
+		best = host
+	}
+	return best, max(interval, l.defaultInterval)
+}
+
+// Wait until a request to the host of the url is allowed
+func (l *hostLimiter) wait(rawUrl string) {
+	u, err := url2.Parse(rawUrl)
+	if err != nil || len(u.Host) == 0 {
+		return
+	}
+	domain, interval := l.domain(u.Hostname())
+	if interval <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	if l.next == nil {
+		l.next = make(map[string]time.Time)
+	}
+	now := time.Now()
+	at := l.next[domain]
+	if at.Before(now) {
+		at = now
+	}
+	l.next[domain] = at.Add(interval)
+	l.mu.Unlock()
+
+	if d := time.Until(at); d > 0 {
+		slog.Debug("Rate limiting request", "url", rawUrl, "domain", domain, "wait", d)
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a structured configuration file, an alternative to stanza files.
+// Settings are named as the command line flags, flags given on the command
+// line take precedence. Entries are playlists with per entry options, named
+// as the options in stanza url fragments.
+//
+//	destination: /media/youtube
+//	maxAge: 30d
+//	nfo: episode
+//	entries:
+//	  - title: Veritasium
+//	    url: https://www.youtube.com/@veritasium
+//	    sections: [playlists, releases]
+//	    maxItems: 50
+//	  - title: News
+//	    url: https://www.reddit.com/r/news
+//	    refresh: 30m
+//	    destination: /media/news
+type Config struct {
+	settings map[string]string
+	entries  []ConfigEntry
+}
+
+type ConfigEntry struct {
+	Title       string            `yaml:"title"`
+	Url         string            `yaml:"url"`
+	Sections    []string          `yaml:"sections"`
+	Destination string            `yaml:"destination"`
+	Options     map[string]string `yaml:",inline"`
+	line        int
+}
+
+// Channel sections and the url fragment flags selecting them
+var sectionFlags = map[string]string{
+	"playlists": "p",
+	"releases":  "r",
+}
+
+func isConfigFile(filename string) bool {
+	ext := path.Ext(filename)
+	return ext == ".yaml" || ext == ".yml"
+}
+
+func loadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var nodes map[string]yaml.Node
+	err = yaml.Unmarshal(data, &nodes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	config := &Config{settings: make(map[string]string)}
+	for key, node := range nodes {
+		if key == "entries" {
+			var entryNodes []yaml.Node
+			err = node.Decode(&entryNodes)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: entries: %w", filename, node.Line, err)
+			}
+			for _, entryNode := range entryNodes {
+				entry := ConfigEntry{line: entryNode.Line}
+				err = entryNode.Decode(&entry)
+				if err != nil {
+					return nil, fmt.Errorf("%s:%d: %w", filename, entryNode.Line, err)
+				}
+				config.entries = append(config.entries, entry)
+			}
+			continue
+		}
+		if node.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("%s:%d: setting %s must be a single value", filename, node.Line, key)
+		}
+		if key == "config" || flag.Lookup(key) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown setting %s", filename, node.Line, key)
+		}
+		config.settings[key] = node.Value
+	}
+	return config, nil
+}
+
+// Set the flags not given on the command line from the config settings
+func (config *Config) applySettings() error {
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+	for key, value := range config.settings {
+		if explicit[key] {
+			continue
+		}
+		err := flag.Set(key, value)
+		if err != nil {
+			return fmt.Errorf("invalid setting %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// Entries of the config, in file order, with options on top of the given
+// options. Invalid and duplicate entries are left out and returned as
+// Diagnostics.
+func (config *Config) playlistEntries(filename string, options Options) ([]Entry, Diagnostics) {
+	var diagnostics Diagnostics
+	entries := make([]Entry, 0, len(config.entries))
+	for _, configEntry := range config.entries {
+		entry, err := configEntry.entry(options)
+		if err != nil {
+			diagnostics = append(diagnostics, Diagnostic{file: filename, line: configEntry.line, message: err.Error()})
+			continue
+		}
+		entry.file = filename
+		entries = append(entries, entry)
+	}
+	entries, duplicates := removeDuplicates(entries)
+	return entries, append(diagnostics, duplicates...).sorted()
+}
+
+func (configEntry ConfigEntry) entry(options Options) (Entry, error) {
+	if len(configEntry.Title) == 0 || len(configEntry.Url) == 0 {
+		return Entry{}, fmt.Errorf("entry must have a title and a url")
+	}
+	if !isUrl(configEntry.Url) {
+		return Entry{}, fmt.Errorf("invalid url %s", configEntry.Url)
+	}
+	options, err := options.forUrl(configEntry.Url)
+	if err != nil {
+		return Entry{}, err
+	}
+	if len(configEntry.Sections) > 0 {
+		options.sections = ""
+		for _, section := range configEntry.Sections {
+			sectionFlag, ok := sectionFlags[section]
+			if !ok {
+				return Entry{}, fmt.Errorf("unknown section %s", section)
+			}
+			options.sections += sectionFlag
+		}
+	}
+	for key, value := range configEntry.Options {
+		err := options.set(strings.ToLower(key), value)
+		if err != nil {
+			return Entry{}, err
+		}
+	}
+	return Entry{
+		title:          configEntry.Title,
+		url:            configEntry.Url,
+		destinationDir: configEntry.Destination,
+		options:        options,
+		line:           configEntry.line,
+	}, nil
+}
+
+// Read the entries of a config file. The prefix is the given name, or the
+// name of the config file without extension
+func readConfigEntries(filename string, name string) (string, []Entry, error) {
+	config, err := loadConfig(filename)
+	if err != nil {
+		return "", nil, err
+	}
+	prefix := name
+	if len(prefix) == 0 {
+		prefix = strings.TrimSuffix(path.Base(filename), path.Ext(filename))
+	}
+	entries, diagnostics := config.playlistEntries(filename, defaultOptions)
+	if len(diagnostics) > 0 {
+		return prefix, entries, diagnostics
+	}
+	return prefix, entries, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// DMS resources of an item are templates per source, one resource per line
+// or separated by ;, each a mime type followed by the command that streams
+// the item. Both are text/templates over the item fields, for example
+//
+//	video/mp4 play-stream {{quote .Id}}; audio/mp4 play-stream --audio {{quote .Id}}
+//
+// Values from feeds are not to be trusted, quote shell quotes them.
+//
+// Sources without resources get no .dms.json file.
+var dmsDefaults = map[string]string{
+	"youtube":   "video/mp4 play-stream {{quote .Id}}",
+	"enclosure": "{{.MimeType}} curl --silent --location {{quote .Url}}",
+}
+
+// The DMS resources spec of the source, from the options or the defaults
+func dmsSpec(source string, options Options) string {
+	if spec, ok := options.dms[source]; ok {
+		return spec
+	}
+	if spec, ok := options.dms[""]; ok {
+		return spec
+	}
+	return dmsDefaults[source]
+}
+
+func setDmsSpec(source, spec string, specs map[string]string) (map[string]string, error) {
+	_, err := parseDmsSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	specs = maps.Clone(specs)
+	if specs == nil {
+		specs = make(map[string]string)
+	}
+	specs[source] = spec
+	return specs, nil
+}
+
+func parseDmsSpec(spec string) ([]string, error) {
+	var resources []string
+	for _, resource := range strings.FieldsFunc(spec, func(r rune) bool { return r == ';' || r == '\n' }) {
+		resource = strings.TrimSpace(resource)
+		if len(resource) == 0 {
+			continue
+		}
+		if _, _, found := strings.Cut(resource, " "); !found {
+			return nil, fmt.Errorf("dms resource %q must be a mime type followed by a command", resource)
+		}
+		_, err := template.New("dms").Funcs(templateFuncs).Parse(resource)
+		if err != nil {
+			return nil, err
+		}
+		resources = append(resources, resource)
+	}
+	return resources, nil
+}
+
+// The DMS resources of an item in the playlist with the given name. Resources
+// using item fields that are empty, such as the id of an SVT item, are
+// skipped and reported in the error.
+func dmsResources(item PlaylistItem, name string, options Options) ([]DmsResource, error) {
+	specs, err := parseDmsSpec(dmsSpec(item.source, options))
+	if err != nil {
+		return nil, err
+	}
+	data := newItemData(item, name)
+	resources := make([]DmsResource, 0, len(specs))
+	var missing []string
+	for _, spec := range specs {
+		t, err := template.New("dms").Funcs(templateFuncs).Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if fields := emptyFields(t.Tree.Root, data); len(fields) > 0 {
+			missing = append(missing, fmt.Sprintf("%q needs %s", spec, strings.Join(fields, ", ")))
+			continue
+		}
+		var sb strings.Builder
+		err = t.Execute(&sb, data)
+		if err != nil {
+			return nil, err
+		}
+		mimeType, command, _ := strings.Cut(strings.TrimSpace(sb.String()), " ")
+		resources = append(resources, DmsResource{MimeType: mimeType, Command: strings.TrimSpace(command)})
+	}
+	if len(missing) > 0 {
+		err = fmt.Errorf("missing item fields for dms resources: %s", strings.Join(missing, "; "))
+	}
+	return resources, err
+}
+
+// The item fields used unconditionally by the template, outside if, with and
+// range, that are empty in the data
+func emptyFields(list *parse.ListNode, data ItemData) []string {
+	var fields []string
+	for _, node := range list.Nodes {
+		action, ok := node.(*parse.ActionNode)
+		if !ok {
+			continue
+		}
+		for _, cmd := range action.Pipe.Cmds {
+			for _, arg := range cmd.Args {
+				field, ok := arg.(*parse.FieldNode)
+				if !ok || len(field.Ident) != 1 {
+					continue
+				}
+				if value, err := executeTemplate("{{."+field.Ident[0]+"}}", data); err == nil && len(value) == 0 {
+					fields = append(fields, field.Ident[0])
+				}
+			}
+		}
+	}
+	return fields
+}
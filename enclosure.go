@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mmcdole/gofeed"
+)
+
+// Podcasts and other feeds with media enclosures. Items not handled by any
+// other source are streamed directly from their first audio or video
+// enclosure.
+type enclosureSource struct{}
+
+func (enclosureSource) Name() string {
+	return "enclosure"
+}
+
+// Enclosure feeds are plain feed urls, parsed by the fallback
+func (enclosureSource) Match(url string) bool {
+	return false
+}
+
+func (enclosureSource) Parse(title, url, destinationDir, prefix string, parseChannelPlaylists bool, options Options) error {
+	return parseAndWritePlaylists(title, stripFragment(url), destinationDir, prefix, options)
+}
+
+func (enclosureSource) Stream(item *gofeed.Item) (Stream, bool) {
+	for _, enclosure := range item.Enclosures {
+		if !strings.HasPrefix(enclosure.Type, "audio/") && !strings.HasPrefix(enclosure.Type, "video/") {
+			continue
+		}
+		if len(enclosure.URL) == 0 {
+			continue
+		}
+		// Podcast guids are often urls, hash them into a stable id
+		id := item.GUID
+		if len(id) == 0 {
+			id = enclosure.URL
+		}
+		sum := sha1.Sum([]byte(id))
+		return Stream{id: hex.EncodeToString(sum[:8]), url: enclosure.URL, strmUrl: enclosure.URL, mimeType: enclosure.Type}, true
+	}
+	return Stream{}, false
+}
+
+func (enclosureSource) Recurse(item PlaylistItem) (string, bool) {
+	return "", false
+}
+
+// Duration of an item from itunes:duration, given in seconds or as
+// [hh:]mm:ss
+func itemDuration(item *gofeed.Item) time.Duration {
+	if item.ITunesExt == nil || len(item.ITunesExt.Duration) == 0 {
+		return 0
+	}
+	seconds := 0
+	for _, part := range strings.Split(strings.TrimSpace(item.ITunesExt.Duration), ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return time.Duration(seconds) * time.Second
+}
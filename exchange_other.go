@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Exchanging directories atomically is only supported on Linux
+func exchangeDirs(a, b string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"time"
+)
+
+// Filter of the items of a playlist, applied before the playlist is written.
+// Include and exclude are regular expressions matched against the title and
+// description of an item, author against its author, and after and before
+// bound its publish time. Use (?i) for case insensitive matching.
+type Filter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
+	author  *regexp.Regexp
+	after   time.Time
+	before  time.Time
+}
+
+// Option keys of the filter
+var filterKeys = []string{"include", "exclude", "author", "after", "before"}
+
+// Set a filter rule. An empty value removes the rule.
+func (filter *Filter) set(key, value string) error {
+	var err error
+	switch key {
+	case "include":
+		filter.include, err = compileFilter(value)
+	case "exclude":
+		filter.exclude, err = compileFilter(value)
+	case "author":
+		filter.author, err = compileFilter(value)
+	case "after":
+		filter.after, err = parseFilterDate(value)
+	case "before":
+		filter.before, err = parseFilterDate(value)
+	default:
+		err = fmt.Errorf("unknown filter %s", key)
+	}
+	return err
+}
+
+func compileFilter(value string) (*regexp.Regexp, error) {
+	if len(value) == 0 {
+		return nil, nil
+	}
+	return regexp.Compile(value)
+}
+
+// Parse a date such as 2024-01-31, or a time such as 2024-01-31T18:00:00Z
+func parseFilterDate(value string) (time.Time, error) {
+	if len(value) == 0 {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %s, must be YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// The rule that drops the item, or false if the item passes the filter
+func (filter Filter) drops(item PlaylistItem) (string, bool) {
+	switch {
+	case filter.include != nil && !filter.include.MatchString(item.title) && !filter.include.MatchString(item.description):
+		return "include=" + filter.include.String(), true
+	case filter.exclude != nil && (filter.exclude.MatchString(item.title) || filter.exclude.MatchString(item.description)):
+		return "exclude=" + filter.exclude.String(), true
+	case filter.author != nil && !filter.author.MatchString(item.author):
+		return "author=" + filter.author.String(), true
+	case !filter.after.IsZero() && item.time.Before(filter.after):
+		return "after=" + filter.after.Format(time.RFC3339), true
+	case !filter.before.IsZero() && !item.time.Before(filter.before):
+		return "before=" + filter.before.Format(time.RFC3339), true
+	}
+	return "", false
+}
+
+// Keep the items of the playlist that pass the filter
+func filterItems(title string, playlist []PlaylistItem, filter Filter) []PlaylistItem {
+	filtered := make([]PlaylistItem, 0, len(playlist))
+	for _, item := range playlist {
+		if rule, ok := filter.drops(item); ok {
+			slog.Debug("Item filtered out", "playlist", title, "title", item.title, "rule", rule)
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
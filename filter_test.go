@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFilterDrops(t *testing.T) {
+	item := PlaylistItem{
+		title:       "Weekly show #shorts",
+		description: "Sponsored by someone",
+		author:      "Some Channel",
+		time:        time.Date(2024, 6, 15, 12, 0, 0, 0, time.UTC),
+	}
+	tests := []struct {
+		rules map[string]string
+		rule  string
+		drops bool
+	}{
+		{nil, "", false},
+		{map[string]string{"include": "Weekly"}, "", false},
+		{map[string]string{"include": "Sponsored"}, "", false},
+		{map[string]string{"include": "Daily"}, "include=Daily", true},
+		{map[string]string{"exclude": "(?i)#SHORTS"}, "exclude=(?i)#SHORTS", true},
+		{map[string]string{"exclude": "#SHORTS"}, "", false},
+		{map[string]string{"exclude": "Sponsored"}, "exclude=Sponsored", true},
+		{map[string]string{"author": "^Some"}, "", false},
+		{map[string]string{"author": "Other"}, "author=Other", true},
+		{map[string]string{"after": "2024-06-15"}, "", false},
+		{map[string]string{"after": "2024-06-16"}, "after=2024-06-16T00:00:00Z", true},
+		{map[string]string{"before": "2024-06-16"}, "", false},
+		{map[string]string{"before": "2024-06-15T12:00:00Z"}, "before=2024-06-15T12:00:00Z", true},
+		{map[string]string{"include": "Weekly", "exclude": ""}, "", false},
+	}
+	for _, test := range tests {
+		var filter Filter
+		for key, value := range test.rules {
+			err := filter.set(key, value)
+			if err != nil {
+				t.Fatalf("set %s=%s: %v", key, value, err)
+			}
+		}
+		rule, drops := filter.drops(item)
+		if rule != test.rule || drops != test.drops {
+			t.Errorf("filter %v drops = %q, %v, want %q, %v", test.rules, rule, drops, test.rule, test.drops)
+		}
+	}
+}
+
+func TestFilterSetErrors(t *testing.T) {
+	for key, value := range map[string]string{
+		"include": "(",
+		"after":   "yesterday",
+		"before":  "2024-13-01",
+		"unknown": "x",
+	} {
+		var filter Filter
+		if err := filter.set(key, value); err == nil {
+			t.Errorf("set %s=%s: no error", key, value)
+		}
+	}
+}
+
+func TestFilterItems(t *testing.T) {
+	var filter Filter
+	filter.set("exclude", "^Skip")
+	playlist := []PlaylistItem{{title: "Keep 1"}, {title: "Skip me"}, {title: "Keep 2"}}
+	filtered := filterItems("test", playlist, filter)
+	if len(filtered) != 2 || filtered[0].title != "Keep 1" || filtered[1].title != "Keep 2" {
+		t.Errorf("filterItems = %v", filtered)
+	}
+}
@@ -5,6 +5,9 @@ go 1.22
 require (
 	github.com/grokify/html-strip-tags-go v0.0.1
 	github.com/mmcdole/gofeed v1.1.3
+	golang.org/x/sys v0.20.0
+	golang.org/x/text v0.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -15,5 +18,4 @@ require (
 	github.com/modern-go/concurrent v0.0.0-20180228061459-e0a39a4cb421 // indirect
 	github.com/modern-go/reflect2 v0.0.0-20180701023420-4b7aa43c6742 // indirect
 	golang.org/x/net v0.0.0-20210726213435-c6fcb2dbf985 // indirect
-	golang.org/x/text v0.3.6 // indirect
 )
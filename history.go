@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// History is the persisted record of every item ever seen in a feed. Feeds
+// such as YouTube's videos.xml only list the most recent entries, the
+// history keeps track of items after they have dropped out of the feed.
+type History struct {
+	FeedUrl string        `json:"FeedUrl"`
+	Items   []HistoryItem `json:"Items"`
+}
+
+type HistoryItem struct {
+	Key          string        `json:"Key"`
+	Title        string        `json:"Title"`
+	SortTitle    string        `json:"SortTitle"`
+	Description  string        `json:"Description"`
+	Author       string        `json:"Author"`
+	Url          string        `json:"Url"`
+	IconUrl      string        `json:"IconUrl"`
+	StrmUrl      string        `json:"StrmUrl"`
+	Id           string        `json:"Id"`
+	RecursiveUrl string        `json:"RecursiveUrl"`
+	Time         time.Time     `json:"Time"`
+	Duration     time.Duration `json:"Duration,omitempty"`
+	MimeType     string        `json:"MimeType,omitempty"`
+	Source       string        `json:"Source"`
+	FirstSeen    time.Time     `json:"FirstSeen"`
+	LastSeen     time.Time     `json:"LastSeen"`
+	// File name of the item, assigned once so it stays the same while items
+	// with the same title come and go
+	FileName string `json:"FileName,omitempty"`
+}
+
+var stateDir string
+
+// Key identifying an item across runs
+func (item PlaylistItem) key() string {
+	if len(item.id) > 0 {
+		return item.source + ":" + item.id
+	}
+	if len(item.url) > 0 {
+		return item.url
+	}
+	return item.strmUrl
+}
+
+func historyFile(feedUrl string) string {
+	sum := sha1.Sum([]byte(feedUrl))
+	return filepath.Join(stateDir, "history", hex.EncodeToString(sum[:])+".json")
+}
+
+func loadHistory(feedUrl string) (*History, error) {
+	history := &History{FeedUrl: feedUrl}
+	data, err := os.ReadFile(historyFile(feedUrl))
+	if errors.Is(err, fs.ErrNotExist) {
+		return history, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, history)
+	if err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+func (history *History) save() error {
+	if planning {
+		return nil
+	}
+	data, err := json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeStateFile(historyFile(history.FeedUrl), data)
+}
+
+// Record the items of a feed in its history and mark the items that were
+// seen in earlier runs. If regenerate is set, all items in the history are
+// returned, newest first, otherwise only the items currently in the feed.
+func recordHistory(feedUrl string, playlist []PlaylistItem, regenerate bool) ([]PlaylistItem, error) {
+	defer historyLocks.lock(feedUrl)()
+	history, err := loadHistory(feedUrl)
+	if err != nil {
+		return playlist, err
+	}
+
+	index := make(map[string]int)
+	for i, historyItem := range history.Items {
+		index[historyItem.Key] = i
+	}
+
+	now := time.Now()
+	newItems := 0
+	for i := range playlist {
+		item := &playlist[i]
+		key := item.key()
+		historyItem := HistoryItem{
+			Key:          key,
+			Title:        item.title,
+			SortTitle:    item.sorttitle,
+			Description:  item.description,
+			Author:       item.author,
+			Url:          item.url,
+			IconUrl:      item.iconUrl,
+			StrmUrl:      item.strmUrl,
+			Id:           item.id,
+			RecursiveUrl: item.recursiveUrl,
+			Time:         item.time,
+			Duration:     item.duration,
+			MimeType:     item.mimeType,
+			Source:       item.source,
+			FirstSeen:    now,
+			LastSeen:     now,
+		}
+		if j, ok := index[key]; ok {
+			item.seen = true
+			historyItem.FirstSeen = history.Items[j].FirstSeen
+			historyItem.FileName = history.Items[j].FileName
+			history.Items[j] = historyItem
+		} else {
+			slog.Debug("New item", "title", item.title, "key", key, "feed", feedUrl)
+			newItems++
+			index[key] = len(history.Items)
+			history.Items = append(history.Items, historyItem)
+		}
+	}
+	slog.Debug("Recorded history", "feed", feedUrl, "newItems", newItems, "knownItems", len(history.Items))
+	history.assignFileNames()
+	for i := range playlist {
+		playlist[i].fileName = history.Items[index[playlist[i].key()]].FileName
+	}
+
+	err = history.save()
+	if err != nil {
+		return playlist, err
+	}
+	if !regenerate {
+		return playlist, nil
+	}
+
+	all := make([]PlaylistItem, 0, len(history.Items))
+	for _, historyItem := range history.Items {
+		item := historyItem.playlistItem()
+		item.seen = historyItem.FirstSeen.Before(now)
+		all = append(all, item)
+	}
+	slices.SortStableFunc(all, func(a, b PlaylistItem) int {
+		return b.time.Compare(a.time)
+	})
+	return all, nil
+}
+
+func (historyItem HistoryItem) playlistItem() PlaylistItem {
+	return PlaylistItem{
+		title:        historyItem.Title,
+		sorttitle:    historyItem.SortTitle,
+		description:  historyItem.Description,
+		author:       historyItem.Author,
+		url:          historyItem.Url,
+		iconUrl:      historyItem.IconUrl,
+		strmUrl:      historyItem.StrmUrl,
+		id:           historyItem.Id,
+		recursiveUrl: historyItem.RecursiveUrl,
+		time:         historyItem.Time,
+		duration:     historyItem.Duration,
+		mimeType:     historyItem.MimeType,
+		source:       historyItem.Source,
+		fileName:     historyItem.FileName,
+	}
+}
+
+// Give the items of the history that have no file name one, avoiding the
+// names already given. Names are never reassigned, so an item does not take
+// over the files of another item with the same title.
+func (history *History) assignFileNames() {
+	items := make([]PlaylistItem, len(history.Items))
+	for i, historyItem := range history.Items {
+		items[i] = historyItem.playlistItem()
+	}
+	for i, name := range itemFileNames(items) {
+		history.Items[i].FileName = name
+	}
+}
@@ -1,23 +1,21 @@
 package main
 
 import (
-	"encoding/xml"
-
 	"bufio"
+	"bytes"
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"html"
-	"io"
 	"log"
 	"log/slog"
-	"net/http"
-	url2 "net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
-	"slices"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	strip "github.com/grokify/html-strip-tags-go"
@@ -45,22 +43,124 @@ type PlaylistItem struct {
 	id           string
 	recursiveUrl string
 	time         time.Time
+	duration     time.Duration
+	mimeType     string
+	source       string
+	seen         bool
+	// File name assigned to the item in its feed history, without extension
+	fileName string
+}
+
+// A playlist to parse, from a stanza file or a config file
+type Entry struct {
+	title string
+	url   string
+	// Destination directory overriding the global destination, if set
+	destinationDir string
+	options        Options
+	// Where the entry was read, for diagnostics
+	file string
+	line int
+}
+
+// Information about a playlist, from its feed
+type PlaylistInfo struct {
+	feedUrl     string
+	title       string
+	description string
+	imageUrl    string
 }
 
 var channels map[string]string
-var sleep *int
+var channelsMu sync.Mutex
+var keepHistory *bool
+var regenerate *bool
+var reconcileMode *string
+var reportFile *string
 
 func main() {
 
+	// The command is the first argument, if it is not a flag
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [run|plan|serve|validate|resolver] [flags]\n\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "  run\tParse the stanza file once and exit (default)\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  plan\tParse the stanza file and report the files that would be created, updated or deleted, without writing\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  serve\tKeep running, refreshing each entry on its own interval\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  validate\tCheck the stanza file, exiting non-zero if it has malformed or duplicate entries\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "  resolver\tOnly serve the resolver endpoint, resolving items to stream urls when played\n\n")
+		flag.PrintDefaults()
+	}
+
 	var destinationDir = flag.String("destination", ".", "Destination directory")
-	var stanza = flag.String("stanza", "stanzas.txt", "Stanzas text file, or - for stdin")
+	var stanza = flag.String("stanza", "stanzas.txt", "Stanzas text file or YAML config file, or - for stdin")
+	var configFile = flag.String("config", "", "YAML config file with settings, named as the flags, and entries with per entry options. Flags given on the command line take precedence")
 	var name = flag.String("name", "", "Name to use. Required if stanza is stdin")
 	var debug = flag.Bool("debug", false, "Debug logging")
 	var parseChannelPlaylists = flag.Bool("channelPlaylists", false, "Parse channel playlists")
-	sleep = flag.Int("sleep", 0, "Sleep between steps")
-
-	//var stanza = flag.String("age", "0", "Age of files to keep")
-	flag.Parse()
+	var sleep = flag.Int("sleep", 0, "Minimum seconds between requests to the same host, for every host including those given in hostInterval")
+	var hostInterval = flag.String("hostInterval", "youtube.com=1s,svtplay.se=1s,reddit.com=2s", "Minimum interval between requests per host, for example youtube.com=2s,reddit.com=5s. Intervals shorter than -sleep are raised to it")
+	var workers = flag.Int("workers", 4, "Number of feeds to process concurrently")
+	var connectTimeout = flag.Duration("connectTimeout", 10*time.Second, "Timeout for connecting to a server")
+	var readTimeout = flag.Duration("readTimeout", 30*time.Second, "Timeout for reading a response after connecting")
+	var retries = flag.Int("retries", 3, "Number of retries for failed requests")
+	var retryBackoff = flag.Duration("retryBackoff", time.Second, "Backoff before the first retry, doubled for each following retry")
+	var maxAge = flag.String("maxAge", "", "Maximum age of items to keep, for example 72h, 30d or 2w")
+	var maxItems = flag.Int("maxItems", 0, "Maximum number of items to keep per playlist")
+	var state = flag.String("state", "", "State directory for item history. Defaults to .plg in the destination directory")
+	keepHistory = flag.Bool("history", true, "Record every item seen in a feed in the item history")
+	regenerate = flag.Bool("regenerate", false, "Write all items in the item history, not only those currently in the feed. Implies -cache=false")
+	var useCache = flag.Bool("cache", true, "Make conditional requests using cached ETag and Last-Modified, skipping feeds that are not modified")
+	var interval = flag.String("interval", "1h", "Refresh interval of entries in serve mode, for example 30m, 6h or 1d")
+	var nfoProfile = flag.String("nfo", nfoMovie, "NFO profile, movie or episode. Episode writes a tvshow.nfo per playlist directory")
+	reconcileMode = flag.String("reconcile", "", "Find output no longer backed by a stanza entry or feed item, plan lists it and apply removes it. Items no longer in a feed are kept while in its item history")
+	reportFile = flag.String("report", "", "Write a JSON report of the run, with the outcome of each entry, to this file, or to standard output if -")
+	var maxFailures = flag.String("maxFailures", "0", "Exit with status 1 when more entries than this fail, a count or a percentage of the entries such as 10%")
+	var planFormat = flag.String("planFormat", planTable, "Format of the plan report, table or json")
+	var strmProfile = flag.String("strm", strmKodi, "Strm profile, kodi, invidious, tubed, direct or template:<text/template> over the item fields. Profiles for one source are prefixed by the source, separated by ;, for example tubed;svt=direct")
+	var resolverListen = flag.String("resolverListen", "", "Address to serve the resolver endpoint /play/<source>/<id> on in serve and resolver mode, for example :8080")
+	flag.StringVar(&resolverUrl, "resolverUrl", "", "Base url of the resolver written in .strm files by the resolver strm profile. Defaults to http://<hostname>:<port> of resolverListen")
+	var resolverCommand = flag.String("resolverCommand", "yt-dlp --get-url --format best {{.Url}}", "Command resolving an item to a stream url, each argument a text/template over Source, Id and Url")
+	var resolverTimeout = flag.Duration("resolverTimeout", time.Minute, "Timeout for the resolver command")
+	var dms = flag.String("dms", "", "DMS resources for items of all sources, each a mime type and a command as text/templates over the item fields, separated by ;. Sources without resources get no .dms.json. Use {{quote .Url}} to shell quote values")
+	dmsSources := make(map[string]*string)
+	for _, source := range sources {
+		dmsSources[source.Name()] = flag.String("dms."+source.Name(), dmsDefaults[source.Name()], "DMS resources for items from "+source.Name())
+	}
+	var filters = make(map[string]*string)
+	filters["include"] = flag.String("include", "", "Only write items whose title or description matches this regular expression")
+	filters["exclude"] = flag.String("exclude", "", "Do not write items whose title or description matches this regular expression, such as (?i)#shorts")
+	filters["author"] = flag.String("author", "", "Only write items whose author matches this regular expression")
+	filters["after"] = flag.String("after", "", "Only write items published at or after this date, YYYY-MM-DD or RFC 3339")
+	filters["before"] = flag.String("before", "", "Only write items published before this date, YYYY-MM-DD or RFC 3339")
+	var thumbs = flag.Bool("thumbs", false, "Download item thumbnails next to the .strm as <title>-thumb.jpg and reference them in the nfo, instead of the remote image")
+	var artwork = flag.Bool("artwork", false, "Download folder artwork of each playlist as poster.jpg, fanart.jpg and banner.jpg, and reference the poster in tvshow.nfo")
+	var staged = flag.Bool("staged", false, "Write each playlist into a staging directory next to it and swap it into place when complete, so that it is never seen half written")
+	var maxBackoff = flag.Duration("maxBackoff", 24*time.Hour, "Maximum interval between refreshes of a failing entry in serve mode")
+	flag.CommandLine.Parse(args)
+
+	if len(*configFile) == 0 && isConfigFile(*stanza) {
+		*configFile = *stanza
+	}
+	if len(*configFile) > 0 {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = config.applySettings()
+		if err != nil {
+			log.Fatalf("%s: %v", *configFile, err)
+		}
+		if len(config.entries) > 0 {
+			// The entries are read from the config file, also when reloaded
+			*stanza = *configFile
+		}
+	}
 
 	if *debug {
 		var programLevel = new(slog.LevelVar)
@@ -70,277 +170,377 @@ func main() {
 		slog.SetDefault(slog.New(handler))
 	}
 
-	channels = make(map[string]string)
-	parseStanzas(*stanza, *name, *destinationDir, *parseChannelPlaylists)
-}
-
-func parseStanzas(filename string, name string, destinationDir string, parseChannelPlaylists bool) {
-	var file *os.File
-	var err error
-	defer file.Close()
-
-	if filename == "-" {
-		file = os.Stdin
-		slog.Info("Parsing standard input")
-	} else {
-		file, err = os.Open(filename)
+	age, err := parseAge(*maxAge)
+	if err != nil {
+		log.Fatal(err)
+	}
+	refresh, err := parseAge(*interval)
+	if err != nil {
+		log.Fatal(err)
+	}
+	allowedFailures, err := parseMaxFailures(*maxFailures)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = validateReconcileMode(*reconcileMode)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = validatePlanFormat(*planFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if command == "plan" && *reportFile == "-" {
+		log.Fatal("plan writes the plan to standard output, give -report a file")
+	}
+	err = validateNFOProfile(*nfoProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defaultOptions = Options{maxAge: age, maxItems: *maxItems, refresh: refresh, nfo: *nfoProfile, thumbs: *thumbs, artwork: *artwork}
+	err = defaultOptions.set("strm", *strmProfile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(*dms) > 0 {
+		err = defaultOptions.set("dms", *dms)
 		if err != nil {
 			log.Fatal(err)
 		}
-		slog.Info("Parsing stanza file", "filename", filename)
 	}
-
-	prefix := ""
-	if len(name) > 0 {
-		prefix = name
-	} else {
-		filenameRegex := regexp.MustCompile(`(.*).txt`)
-		filenameMatches := filenameRegex.FindStringSubmatch(path.Base(file.Name()))
-		if len(filenameMatches) > 0 {
-			prefix = filenameMatches[1]
+	for _, key := range filterKeys {
+		err = defaultOptions.set(key, *filters[key])
+		if err != nil {
+			log.Fatal(err)
 		}
 	}
-
-	if prefix == "" {
-		slog.Info("If name not given, filename must end with .txt", "filename", file.Name())
-	} else {
-		scanner := bufio.NewScanner(file)
-		lines := make([]string, 0)
-		for scanner.Scan() {
-			lines = append(lines, scanner.Text())
-			slog.Debug("Scanned line", "line", scanner.Text())
+	flag.Visit(func(f *flag.Flag) {
+		if source, ok := strings.CutPrefix(f.Name, "dms."); ok {
+			err := defaultOptions.set(f.Name, *dmsSources[source])
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
+	})
 
-		playlistMap := createPlaylistMap(lines)
-		parsePlaylists(playlistMap, destinationDir, prefix, parseChannelPlaylists)
-
-		if err := scanner.Err(); err != nil {
-			log.Fatal(err)
-		}
+	limiter.intervals, err = parseHostIntervals(*hostInterval)
+	if err != nil {
+		log.Fatal(err)
 	}
-}
+	limiter.defaultInterval = time.Duration(*sleep) * time.Second
+	initWorkers(*workers)
+	client = newClient(*connectTimeout, *readTimeout, *retries, *retryBackoff)
 
-// Create a map from list of lines with title followed by url
-func createPlaylistMap(lines []string) map[string]string {
+	stateDir = *state
+	if len(stateDir) == 0 {
+		stateDir = *destinationDir + "/.plg"
+	}
 
-	playlistMap := make(map[string]string)
-	for i, line := range lines {
-		if strings.HasPrefix(line, "http") {
-			if i > 0 {
-				title := lines[i-1]
-				url := lines[i]
-				playlistMap[url] = title
-			}
-		}
+	if *useCache && !*regenerate {
+		cache = &httpCache{dir: stateDir + "/cache"}
 	}
-	return playlistMap
-}
 
-func parsePlaylists(playlists map[string]string, destinationDir string, prefix string, parseChannelPlaylists bool) {
-	for url, title := range playlists {
-		parsePlaylist(title, url, destinationDir, prefix, parseChannelPlaylists)
-		time.Sleep(time.Duration(*sleep) * time.Second)
+	var r *resolver
+	if len(*resolverListen) > 0 {
+		r = newResolver(*resolverListen, *resolverCommand, *resolverTimeout)
+		if len(resolverUrl) == 0 {
+			resolverUrl = defaultResolverUrl(*resolverListen)
+		}
 	}
-}
 
-func parsePlaylist(title, url, destinationDir, prefix string, parseChannelPlaylists bool) {
-	slog.Debug("Parsing playlist", "title", title, "prefix", prefix, "url", url)
-	svtRegex := regexp.MustCompile(`www.svtplay.se\/(.*)\/rss\.xml`)
-	svtMatches := svtRegex.FindStringSubmatch(url)
-	channelRegex := regexp.MustCompile(`youtube.com\/channel\/(.*)`)
-	channelMatches := channelRegex.FindStringSubmatch(url)
-	userRegex := regexp.MustCompile(`youtube.com\/user\/(.*)`)
-	userMatches := userRegex.FindStringSubmatch(url)
-	playlistRegex := regexp.MustCompile(`youtube.com\/playlist\?list=(.*)`)
-	playlistMatches := playlistRegex.FindStringSubmatch(url)
-	cRegex := regexp.MustCompile(`youtube.com\/c\/(.*)`) //Doesn't work. Need a way to figure out channel id in this case
-	cMatches := cRegex.FindStringSubmatch(url)
-
-	redditRegex := regexp.MustCompile(`reddit.com\/r\/([^/]+)`)
-	redditMatches := redditRegex.FindStringSubmatch(url)
-
-	// /itemprop="channelId" content="(.*?)"/ and print $1
-	title = strings.Trim(title, " .")
-
-	if len(svtMatches) > 0 {
-		svtCategory := svtMatches[1]
-		slog.Debug("SVT category detected", "category", svtCategory)
-		parseAndWritePlaylists(title, fmt.Sprintf("https://www.svtplay.se/%s/rss.xml", svtCategory), destinationDir, prefix)
-	} else if len(channelMatches) > 0 {
-		channelID := channelMatches[1]
-		slog.Debug("YouTube channel detected", "channel", channelID)
-		parseAndWriteChannelPlaylists(url, channelID, parseChannelPlaylists, title, destinationDir, prefix)
-	} else if len(cMatches) > 0 {
-		channelID := cMatches[1]
-		slog.Debug("YouTube c channel detected", "channel", channelID)
-		parseAndWriteChannelPlaylists(url, channelID, parseChannelPlaylists, title, destinationDir, prefix)
-	} else if len(userMatches) > 0 {
-		user := userMatches[1]
-		slog.Debug("YouTube user detected", "user", user)
-		parseAndWritePlaylists(title, fmt.Sprintf("https://www.youtube.com/feeds/videos.xml?user=%s", user), destinationDir, prefix)
-	} else if len(playlistMatches) > 0 {
-		playlist := playlistMatches[1]
-		slog.Debug("YouTube playlist detected", "playlist", playlist)
-		parseAndWritePlaylists(title, fmt.Sprintf("https://www.youtube.com/feeds/videos.xml?playlist_id=%s", playlist), destinationDir, prefix)
-	} else if len(redditMatches) > 0 {
-		subreddit := redditMatches[1]
-		slog.Debug("Subreddit detected", "subreddit", subreddit)
-		parseAndWritePlaylists(title, fmt.Sprintf("https://www.reddit.com/r/%s/.rss", subreddit), destinationDir, prefix)
+	channels = make(map[string]string)
+	if *staged {
+		output = newStagedOutput(newChangeLog(*destinationDir))
 	} else {
-		parseAndWritePlaylists(title, url, destinationDir, prefix)
+		output = diskOutput{log: newChangeLog(*destinationDir)}
+	}
+	switch command {
+	case "run":
+		report, err := parseStanzas(*stanza, *name, *destinationDir, *parseChannelPlaylists)
+		if err != nil {
+			slog.Error("Not reconciling", "error", err)
+		}
+		if err != nil || report.exceeds(allowedFailures) {
+			os.Exit(1)
+		}
+	case "plan":
+		planning = true
+		plan := newPlanOutput(*destinationDir)
+		output = plan
+		report, reconcileErr := parseStanzas(*stanza, *name, *destinationDir, *parseChannelPlaylists)
+		if reconcileErr != nil {
+			slog.Error("Not reconciling", "error", reconcileErr)
+		}
+		err = plan.report(os.Stdout, *planFormat)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if reconcileErr != nil || report.exceeds(allowedFailures) {
+			os.Exit(1)
+		}
+	case "serve":
+		err = serve(*stanza, *name, *destinationDir, *parseChannelPlaylists, *workers, *maxBackoff, r)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "resolver":
+		if r == nil {
+			log.Fatal("resolver needs -resolverListen")
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		err = r.serve(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "validate":
+		os.Exit(validate(*stanza, *name))
+	default:
+		flag.Usage()
+		os.Exit(2)
 	}
 }
 
-func parseAndWriteChannelPlaylists(url string, channelID string, parseChannelPlaylists bool, title string, destinationDir string, prefix string) {
-
-	fragmentRegex := regexp.MustCompile(`#([^#]+)$`)
-	match := fragmentRegex.FindStringSubmatch(url)
-
-	parseVideos := true
-	fragment := ""
-	if len(match) > 1 {
-		fragment = match[1]
+// Run the entries of a stanza or config file, and reconcile the output if
+// asked to. Output is not reconciled when entries were skipped as invalid,
+// as the output of a skipped entry would be removed, and an error is returned.
+func parseStanzas(filename string, name string, destinationDir string, parseChannelPlaylists bool) (*RunReport, error) {
+	prefix, entries, err := readEntries(filename, name)
+	_, invalid := err.(Diagnostics)
+	err = logDiagnostics(err)
+	if err != nil {
+		log.Fatal(err)
 	}
-	slog.Debug("Parsing channel playlists", "title", title)
-
-	if parseChannelPlaylists || strings.Contains(fragment, "p") { //playlists
-		playlistRegex := "\"playlistId\":\"(PL[a-zA-Z0-9_-]{16,32})\""
-		playlistsSection := "playlists"
-		playlistsExisted := parseAndWriteChannelPlaylistsForSection(channelID, destinationDir, prefix, title, playlistsSection, playlistRegex)
-		parseVideos = parseVideos && !playlistsExisted
+	report := runPlaylists(entries, destinationDir, prefix, parseChannelPlaylists)
+	if len(*reportFile) > 0 {
+		err = report.write(*reportFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	if parseChannelPlaylists || strings.Contains(fragment, "r") { //releases
-		releasesRegex := "\"playlistId\":\"(OL[a-zA-Z0-9_-]{39})\""
-		releasesSection := "releases"
-		releasesExisted := parseAndWriteChannelPlaylistsForSection(channelID, destinationDir, prefix, title, releasesSection, releasesRegex)
-		parseVideos = parseVideos && !releasesExisted
+
+	if len(*reconcileMode) > 0 {
+		if invalid {
+			return report, fmt.Errorf("%s has invalid entries, whose output would be removed", filename)
+		}
+		for _, root := range reconcileRoots(entries, destinationDir, prefix) {
+			err = reconcile(root, *reconcileMode)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
+	return report, nil
+}
 
-	if parseVideos {
-		parseAndWritePlaylists(title, fmt.Sprintf("https://www.youtube.com/feeds/videos.xml?channel_id=%s", channelID), destinationDir, prefix)
+// Read the entries of a config file, or of a stanza file
+func readEntries(filename string, name string) (string, []Entry, error) {
+	if isConfigFile(filename) {
+		slog.Info("Parsing config file", "filename", filename)
+		return readConfigEntries(filename, name)
 	}
+	return readStanzas(filename, name)
 }
 
-func parseAndWriteChannelPlaylistsForSection(channelID string, destinationDir string, prefix string, title string,
-	section string, playlistRegex string) bool {
-	playlistIds := getYoutubePlaylistsForChannel(channelID, section, playlistRegex)
-	playlistMap := make(map[string]string)
-	for _, playlistId := range playlistIds {
-		playlistName := getYoutubePlaylistName(playlistId)
-		if len(playlistName) < 1 {
-			playlistName = playlistId
-		}
-		playlistURL := "https://www.youtube.com/playlist?list=" + playlistId
-		playlistMap[playlistURL] = playlistName
+// Read a stanza file into a prefix and its entries. The prefix is the given
+// name, or the name of the stanza file without .txt. Malformed and duplicate
+// entries are left out and returned as Diagnostics.
+func readStanzas(filename string, name string) (string, []Entry, error) {
+	var file *os.File
+	var err error
 
-		time.Sleep(time.Duration(*sleep) * time.Second)
-	}
-	if len(playlistMap) > 0 {
-		parsePlaylists(playlistMap, destinationDir+"/"+prefix+"/"+title, section, false)
-		return true
+	if filename == "-" {
+		file = os.Stdin
+		slog.Info("Parsing standard input")
 	} else {
-		return false
+		file, err = os.Open(filename)
+		if err != nil {
+			return "", nil, err
+		}
+		defer file.Close()
+		slog.Info("Parsing stanza file", "filename", filename)
 	}
-}
 
-func getYoutubePlaylistsForChannel(channelId string, section string, extractionRegex string) []string {
-	re, err := regexp.Compile(extractionRegex)
-	if err != nil {
-		slog.Error("Error compiling regex", "regex", re, "error", err)
-		return nil
+	prefix := ""
+	if len(name) > 0 {
+		prefix = name
+	} else {
+		filenameRegex := regexp.MustCompile(`(.*).txt`)
+		filenameMatches := filenameRegex.FindStringSubmatch(path.Base(file.Name()))
+		if len(filenameMatches) > 0 {
+			prefix = filenameMatches[1]
+		}
 	}
 
-	channelPlaylistsUrl := "https://www.youtube.com/channel/" + channelId + "/" + section
-	resp, err := http.Get(channelPlaylistsUrl)
-	if err != nil {
-		slog.Error("Error fetching URL", "url", channelPlaylistsUrl, "error", err)
-		return nil
+	if prefix == "" {
+		return "", nil, fmt.Errorf("if name not given, filename must end with .txt: %s", file.Name())
 	}
-	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Error("Error reading response body for url", "url", channelPlaylistsUrl, "error", err)
-		return nil
+	scanner := bufio.NewScanner(file)
+	lines := make([]string, 0)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+		slog.Debug("Scanned line", "line", scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
 	}
 
-	var playlistIds []string
-	matches := re.FindAllStringSubmatch(string(body), -1)
-	for _, match := range matches {
-		if len(match) > 1 {
-			playlistIds = append(playlistIds, match[1])
-		}
+	entries, diagnostics := parseStanzaLines(file.Name(), lines)
+	if len(diagnostics) > 0 {
+		return prefix, entries, diagnostics
 	}
+	return prefix, entries, nil
+}
 
-	slices.Sort(playlistIds)
-	return slices.Compact(playlistIds)
+func parsePlaylists(entries []Entry, destinationDir string, prefix string, parseChannelPlaylists bool) {
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		runWorker(&wg, func() {
+			parsePlaylist(entry, destinationDir, prefix, parseChannelPlaylists)
+		})
+	}
+	wg.Wait()
 }
 
-func getYoutubePlaylistName(playlistId string) string {
-	titleRegex := "<title>(.*?)(?:- YouTube)?</title>"
-	re, err := regexp.Compile(titleRegex)
-	if err != nil {
-		slog.Error("Error compiling regex", "regex", re, "error", err)
-		return ""
+func parsePlaylist(entry Entry, destinationDir, prefix string, parseChannelPlaylists bool) error {
+	slog.Debug("Parsing playlist", "title", entry.title, "prefix", prefix, "url", entry.url)
+	title := strings.Trim(entry.title, " .")
+	if len(entry.destinationDir) > 0 {
+		destinationDir = entry.destinationDir
 	}
 
-	playlistUrl := "https://www.youtube.com/playlist?list=" + playlistId
-	resp, err := http.Get(playlistUrl)
+	err := parseSource(title, entry.url, destinationDir, prefix, parseChannelPlaylists, entry.options)
 	if err != nil {
-		slog.Error("Error fetching URL", "url", playlistUrl, "error", err)
-		return ""
+		// Keep the output of the entry as it is, since it could not be refreshed
+		produced.keepDir(entryDir(entry, destinationDir, prefix))
 	}
-	defer resp.Body.Close()
+	return err
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Error("Error reading response body for url", "url", playlistUrl, "error", err)
-		return ""
+// The playlist directory of an entry
+func entryDir(entry Entry, destinationDir, prefix string) string {
+	if len(entry.destinationDir) > 0 {
+		destinationDir = entry.destinationDir
 	}
+	return destinationDir + "/" + prefix + "/" + playlistDirName(strings.Trim(entry.title, " ."))
+}
 
-	matches := re.FindAllStringSubmatch(string(body), -1)
-	for _, match := range matches {
-		if len(match) > 1 {
-			return html.UnescapeString(match[1])
-		} else {
-			slog.Error("Could not find title match for playlist", "url", playlistUrl)
+func parseSource(title, url, destinationDir, prefix string, parseChannelPlaylists bool, options Options) error {
+	for _, source := range sources {
+		if source.Match(url) {
+			slog.Debug("Source detected", "source", source.Name(), "url", url)
+			return source.Parse(title, url, destinationDir, prefix, parseChannelPlaylists, options)
 		}
 	}
-	slog.Error("Could not find title match for playlist, returning", "url", playlistUrl)
-	return ""
+	return parseAndWritePlaylists(title, stripFragment(url), destinationDir, prefix, options)
 }
 
-func parseAndWritePlaylists(title string, url string, destinationDir string, prefix string) error {
+func parseAndWritePlaylists(title string, url string, destinationDir string, prefix string, options Options) error {
 	slog.Info("Parsing playlist", "title", title, "url", url)
 	if len(url) > 0 {
-		_, playlist := parseFeed(url)
-		if playlist == nil {
+		dir := destinationDir + "/" + prefix + "/" + playlistDirName(title) + "/"
+		// Validators are kept per playlist directory and options, a feed written to several playlists is
+		// written to each, and written again when its options change
+		// A playlist that is not written still recovers from an interrupted swap
+		err := recoverStaged(dir)
+		if err != nil {
+			slog.Error("Could not recover staged playlist", "directory", dir, "error", err)
+		}
+		resp, err := client.getConditional(url, url+" "+dir+" "+options.fingerprint())
+		if err != nil {
+			slog.Error("Error fetching feed", "url", url, "error", err)
+			produced.keepDir(dir)
+			runReport.feed(dir, url, statusFailed, 0, err)
+			return err
+		}
+		if resp.notModified {
+			slog.Info("Feed not modified, skipping playlist", "title", title, "url", url)
+			produced.keepDir(dir)
+			err = applyRetention(dir, options)
+			if err != nil {
+				slog.Error("Could not apply retention policy", "directory", dir, "error", err)
+			}
+			runReport.feed(dir, url, statusUnchanged, countItems(dir), nil)
+			writeRecursions(resp.entry.Recursions, destinationDir, prefix, title, options)
+			return nil
+		}
+
+		info, playlist, err := parseFeed(url, resp.body)
+		if err != nil {
+			produced.keepDir(dir)
+			runReport.feed(dir, url, statusFailed, 0, err)
+			return err
+		}
+		if len(playlist) == 0 {
 			slog.Debug("Skipping playlist", "title", title)
+			// Keep what was written before, as a feed can be empty for a while
+			produced.keepDir(dir)
+			runReport.feed(dir, url, statusEmpty, 0, nil)
 			return nil
 		} else {
-			slog.Debug("Writing playlist", "title", title)
-			err := writePlaylist(destinationDir, prefix, title, playlist)
+			if *keepHistory {
+				playlist, err = recordHistory(url, playlist, *regenerate)
+				if err != nil {
+					slog.Error("Error recording item history", "url", url, "error", err)
+				}
+			}
+			playlist = filterItems(title, playlist, options.filter)
+			newItems := 0
+			for _, item := range playlist {
+				if *keepHistory && !item.seen {
+					newItems++
+				}
+			}
+			slog.Debug("Writing playlist", "title", title, "items", len(playlist), "newItems", newItems)
+			recursions, err := writePlaylist(destinationDir, prefix, title, info, playlist, options)
 			if err != nil {
 				slog.Error("Error writing playlist", "playlist", playlist, "title", title, "error", err)
-				//fmt.Errorf("Error while writing playlist for %v;  %v", playlist, err)
+				produced.keepDir(dir)
+				err = fmt.Errorf("error writing playlist %s: %w", title, err)
+				runReport.feed(dir, url, statusFailed, 0, err)
+				return err
 			}
+			resp.entry.Recursions = recursions
+			resp.commit()
+			if *keepHistory {
+				err = produced.addHistory(dir, url, options.filter)
+				if err != nil {
+					slog.Error("Could not read item history, items no longer in the feed are not backed", "url", url, "error", err)
+					produced.keepDir(dir)
+				}
+			}
+			runReport.feed(dir, url, statusWritten, countItems(dir), nil)
+			runReport.newItems(dir, newItems)
+			writeRecursions(recursions, destinationDir, prefix, title, options)
 		}
 	}
 	return nil
 }
 
-func parseFeed(url string) (string, []PlaylistItem) {
+// Write the playlists that the items of a playlist refer to, within the
+// directory of the playlist
+func writeRecursions(recursions []Recursion, destinationDir, prefix, title string, options Options) {
+	programPrefix := prefix + "/" + playlistDirName(title)
+	for _, recursion := range recursions {
+		parseAndWritePlaylists(recursion.Title, recursion.Url, destinationDir, programPrefix, options)
+	}
+}
+
+func parseFeed(url string, body []byte) (PlaylistInfo, []PlaylistItem, error) {
 	fp := gofeed.NewParser()
-	feed, err := fp.ParseURL(url)
+	feed, err := fp.Parse(bytes.NewReader(body))
 	if err != nil {
-		slog.Error("Error writing playlist", "url", url, "error", err)
-		//fmt.Errorf("Error while writing playlist for %s;  %v \n", url, err)
-		return "", nil
+		slog.Error("Error parsing feed", "url", url, "error", err)
+		return PlaylistInfo{}, nil, fmt.Errorf("error parsing feed %s: %w", url, err)
+	}
+	info := PlaylistInfo{feedUrl: url, title: feed.Title, description: strip.StripTags(feed.Description)}
+	if feed.Image != nil {
+		info.imageUrl = feed.Image.URL
 	}
 	if len(feed.Items) == 0 {
 		slog.Error("No items in feed", "url", url)
-		//fmt.Errorf("No items in feed for  %s \n", url)
-		return "", nil
+		return info, nil, nil
 	}
 	slog.Debug("Parsing feed", "title", feed.Title, "url", url)
 	if feed.Link != "" {
@@ -349,7 +549,9 @@ func parseFeed(url string) (string, []PlaylistItem) {
 		if len(channelMatches) > 0 {
 			channelId := channelMatches[1]
 			slog.Debug("Adding channel", "channel", channelId)
+			channelsMu.Lock()
 			channels[channelId] = feed.Title
+			channelsMu.Unlock()
 		}
 
 		/*
@@ -371,48 +573,8 @@ func parseFeed(url string) (string, []PlaylistItem) {
 			item.Published, "updated", item.Updated, "item", item)
 		//fmt.Printf("Item: %s ; %s ; %s ; %s ; %v", item.PublishedParsed, item.UpdatedParsed, item.Published, item.Updated, item)
 
-		strmUrl := ""
-		id := ""
-		url := ""
-		r := regexp.MustCompile(`www.youtube.com\/watch\?v=(.*)`)
-		matches := r.FindStringSubmatch(item.Link)
-		if len(matches) > 0 {
-			id = matches[1]
-			url = item.Link
-			strmUrl = "plugin://plugin.video.youtube/play/?video_id=" + id
-		}
-
-		if len(strmUrl) == 0 {
-			r := regexp.MustCompile(`www.svtplay.se(\/.*)`)
-			matches := r.FindStringSubmatch(item.Link)
-			url = item.Link
-			if len(matches) > 0 {
-				strmUrl = "plugin://plugin.video.svtplay/?mode=video&id=" + url2.QueryEscape(matches[1])
-			}
-		}
-
-		// For example from Reddit feed, the contents is not item.Link but in item.Content
-		if len(strmUrl) == 0 {
-			r := regexp.MustCompile(`youtube.com\/watch\?v=([a-zA-Z0-9-_]{11})`)
-			matches := r.FindStringSubmatch(item.Content)
-			if len(matches) > 0 {
-				id = matches[1]
-				url = "https://www.youtube.com/watch?v=" + id
-				strmUrl = "plugin://plugin.video.youtube/play/?video_id=" + id
-			}
-		}
-
-		if len(strmUrl) == 0 {
-			r := regexp.MustCompile(`youtu.b\/([a-zA-Z0-9-_]{11})`)
-			matches := r.FindStringSubmatch(item.Content)
-			if len(matches) > 0 {
-				id = matches[1]
-				url = "https://www.youtube.com/watch?v=" + id
-				strmUrl = "plugin://plugin.video.youtube/play/?video_id=" + id
-			}
-		}
-
-		if len(strmUrl) == 0 {
+		source, stream, ok := streamForItem(item)
+		if !ok {
 			continue
 		}
 
@@ -450,12 +612,26 @@ func parseFeed(url string) (string, []PlaylistItem) {
 			time = *item.UpdatedParsed
 		}
 
-		playlistItem := PlaylistItem{title, sorttitle, description, author, url, imageUrl, strmUrl, id, item.Link, time}
+		playlistItem := PlaylistItem{
+			title:        title,
+			sorttitle:    sorttitle,
+			description:  description,
+			author:       author,
+			url:          stream.url,
+			iconUrl:      imageUrl,
+			strmUrl:      stream.strmUrl,
+			id:           stream.id,
+			recursiveUrl: item.Link,
+			time:         time,
+			duration:     itemDuration(item),
+			mimeType:     stream.mimeType,
+			source:       source.Name(),
+		}
 		playlist = append(playlist, playlistItem)
 		slog.Debug("Created playlist item", "title", playlistItem.title, "url", playlistItem.url, "strmUrl", playlistItem.strmUrl)
 		//fmt.Printf("%s %s \n", playlistItem.title, playlistItem.url)
 	}
-	return feed.Title, playlist
+	return info, playlist, nil
 }
 
 func getDescription(item gofeed.Item) string {
@@ -505,185 +681,147 @@ func getImageUrl(item gofeed.Item) string {
 	//return item.Extensions["media"]["group"][0].Children["thumbnail"][0].Attrs["url"]
 }
 
-func writePlaylist(destinationDir string, prefix string, name string, playlist []PlaylistItem) error {
+// Directory name of a playlist
+func playlistDirName(name string) string {
+	return sanitizeName(name)
+}
 
-	n := name
-	n = strings.Replace(n, "+", "", -1)
-	n = strings.Replace(n, "/", "", -1)
-	n = strings.Replace(n, "?", "", -1)
-	n = strings.Replace(n, "|", "", -1)
-	n = strings.Replace(n, ":", "", -1)
+// Write the playlist to its directory. Returns the playlists that its items
+// refer to, to be written once the playlist is complete.
+func writePlaylist(destinationDir string, prefix string, name string, info PlaylistInfo, playlist []PlaylistItem, options Options) ([]Recursion, error) {
 
+	n := playlistDirName(name)
 	dir := destinationDir + "/" + prefix + "/" + n + "/"
-	slog.Debug("Will create directory", "directory", dir)
-	err := os.MkdirAll(dir, os.ModePerm)
+	defer dirLocks.lock(path.Clean(dir))()
+	playlist = retainItems(playlist, options)
+	staged, err := beginStaging(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	epoch := time.Unix(1, 0)
-	err = os.Chtimes(dir, epoch, epoch) // Set both atime and mtime
+	defer staged.abort()
+	slog.Debug("Will create directory", "directory", dir)
+	err = output.MkdirAll(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	slog.Info("Created directory, will now create playlist items", "directory", dir, "noOfItems", len(playlist))
 
 	var mostRecentTime time.Time
 	baseDir := destinationDir + "/" + prefix + "/"
 
-	for _, item := range playlist {
+	// Playlists that items refer to are written after this playlist is complete
+	var recursions []Recursion
+	fileNames := itemFileNames(playlist)
+	for i, item := range playlist {
 
-		title := item.title
-		title = strings.Replace(title, "+", "", -1)
-		title = strings.Replace(title, "/", "", -1)
-		title = strings.Replace(title, "?", "", -1)
-		title = strings.Replace(title, "|", "", -1)
-		title = strings.Replace(title, ":", "", -1)
+		title := fileNames[i]
 		strmfile := dir + title + ".strm"
 		nfofile := dir + title + ".nfo"
 		dmsfile := dir + title + ".dms.json"
 
-		{
-
-			// URL. Disable for now
-			// urlfile := dir + title + ".url"
-			// url, err := os.Create(urlfile)
-			// if err != nil {
-			// 	return err
-			// }
-			// defer url.Close()
-			// defer os.Chtimes(urlfile, item.time, item.time)
-
-			// w := bufio.NewWriter(url)
-			// if err != nil {
-			// 	return err
-			// }
-			// _, err = w.WriteString(item.url)
-			// if err != nil {
-			// 	return err
-			// }
-			// w.Flush()
-
-			// Stream
-			strm, err := os.Create(strmfile)
-			if err != nil {
-				return err
-			}
-			defer strm.Close()
-			defer os.Chtimes(strmfile, item.time, item.time)
+		// Stream
+		strm, err := strmTarget(item, name, options)
+		if err != nil {
+			slog.Error("Could not create stream url, skipping item", "title", item.title, "error", err)
+			continue
+		}
+		err = output.WriteFile(strmfile, []byte(strm+"\n"), item.time)
+		if err != nil {
+			return nil, err
+		}
+		produced.addFile(strmfile)
 
-			var w = bufio.NewWriter(strm)
+		// Thumbnail, a thumbnail that can no longer be downloaded is kept
+		if options.thumbs && len(item.iconUrl) > 0 {
+			thumb, err := writeThumb(dir, title, item)
 			if err != nil {
-				return err
+				slog.Warn("Could not download thumbnail", "title", item.title, "url", item.iconUrl, "error", err)
+				thumb, _ = keepThumb(dir, title)
 			}
-			_, err = w.WriteString(item.strmUrl + "\n")
-			if err != nil {
-				return err
+			if len(thumb) > 0 {
+				item.iconUrl = thumb
 			}
-			w.Flush()
-
-			//Info
-			createNFO(nfofile, item.title, item.sorttitle, item.description, item.iconUrl, name, item.time)
-
-			//DMS
-			dms, err := os.Create(dmsfile)
-			if err != nil {
-				return err
-			}
-			defer dms.Close()
-			defer os.Chtimes(dmsfile, item.time, item.time)
+		}
 
-			w = bufio.NewWriter(dms)
-			if err != nil {
-				return err
-			}
+		//Info
+		err = createItemNFO(nfofile, item, name, options)
+		if err != nil {
+			slog.Error("Could not write nfo file", "file", nfofile, "error", err)
+		} else {
+			produced.addFile(nfofile)
+		}
 
-			command := fmt.Sprintf("play-stream %s", item.id)
-			jsonData, err := json.Marshal(&Dms{Title: item.title, Resources: []DmsResource{{MimeType: "video/mp4", Command: command}}})
+		//DMS
+		resources, err := dmsResources(item, name, options)
+		if err != nil {
+			slog.Warn("Skipping dms resources", "title", item.title, "error", err)
+		}
+		if len(resources) > 0 {
+			jsonData, err := json.Marshal(&Dms{Title: item.title, Resources: resources})
 			if err != nil {
-				return err
+				return nil, err
 			}
-
-			_, err = dms.Write(jsonData)
+			err = output.WriteFile(dmsfile, jsonData, item.time)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			w.Flush()
-
-			if mostRecentTime.IsZero() || mostRecentTime.Before(item.time) {
-				mostRecentTime = item.time
-			}
-		}
-		err = os.Chtimes(strmfile, item.time, item.time)
-		if err != nil {
-			slog.Error("Could not change mtime of strm file", "file", strmfile, "error", err)
+			produced.addFile(dmsfile)
 		}
-		err = os.Chtimes(nfofile, item.time, item.time)
-		if err != nil {
-			slog.Error("Could not change mtime of nfo file", "file", nfofile, "error", err)
+
+		if mostRecentTime.IsZero() || mostRecentTime.Before(item.time) {
+			mostRecentTime = item.time
 		}
 
-		svtProgramRegex := regexp.MustCompile(`www.svtplay.se\/([^\/]+)$`)
-		svtProgramRegexMatches := svtProgramRegex.FindStringSubmatch(item.recursiveUrl)
-		if len(svtProgramRegexMatches) > 0 {
-			svtProgram := svtProgramRegexMatches[1]
-			programPrefix := prefix + "/" + n
-			parseAndWritePlaylists(title, fmt.Sprintf("https://www.svtplay.se/%s/rss.xml", svtProgram), destinationDir, programPrefix)
+		if source := sourceByName(item.source); source != nil {
+			if feedUrl, ok := source.Recurse(item); ok {
+				recursions = append(recursions, Recursion{Title: title, Url: feedUrl})
+			}
 		}
 	}
 
-	err = os.Chtimes(dir, mostRecentTime, mostRecentTime)
-
-	baseDirStat, err := os.Stat(baseDir)
-	if err != nil {
-		return err
+	poster := false
+	if options.artwork && len(playlist) > 0 {
+		poster = writeFolderArtwork(dir, info)
 	}
-	if baseDirStat.ModTime().Before(mostRecentTime) {
-		err = os.Chtimes(baseDir, mostRecentTime, mostRecentTime)
+
+	if options.nfo == nfoEpisode && len(playlist) > 0 {
+		tvshowfile := dir + tvshowNFO
+		err = createTVShowNFO(tvshowfile, name, info, poster, mostRecentTime)
 		if err != nil {
-			slog.Error("Could not change mtime of basedir", "directory", baseDir, "error", err)
+			slog.Error("Could not write tvshow nfo file", "file", tvshowfile, "error", err)
 		}
+		produced.addFile(tvshowfile)
 	}
-	return nil
-}
-
-type NFO struct {
-	XMLName   xml.Name `xml:"movie"`
-	Title     string   `xml:"title"`
-	SortTitle string   `xml:"sorttitle"`
-	Plot      string   `xml:"plot"`
-	Thumb     string   `xml:"thumb"`
-	Tag       string   `xml:"tag"`
-}
 
-func createNFO(nfofile, title, sorttitle, description, iconUrl, tag string, t time.Time) error {
-	nfo, err := os.Create(nfofile)
+	err = applyRetention(dir, options)
 	if err != nil {
-		return err
+		slog.Error("Could not apply retention policy", "directory", dir, "error", err)
 	}
-	defer nfo.Close()
+	logPlaylistChanges(dir)
 
-	defer os.Chtimes(nfofile, t, t)
-
-	movie := NFO{
-		Title:     title,
-		SortTitle: sorttitle,
-		Plot:      description,
-		Thumb:     iconUrl,
-		Tag:       tag,
+	err = output.Chtimes(dir, mostRecentTime)
+	if err != nil && !os.IsNotExist(err) {
+		slog.Error("Could not change mtime of playlist directory", "directory", dir, "error", err)
 	}
-
-	writer := bufio.NewWriter(nfo)
-	encoder := xml.NewEncoder(writer)
-
-	_, err = writer.WriteString(xml.Header)
+	err = staged.commit()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = encoder.Encode(movie)
+	baseDirMu.Lock()
+	defer baseDirMu.Unlock()
+	baseDirModTime, err := output.ModTime(baseDir)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	return writer.Flush()
+	if baseDirModTime.Before(mostRecentTime) {
+		err = output.Chtimes(baseDir, mostRecentTime)
+		if err != nil {
+			slog.Error("Could not change mtime of basedir", "directory", baseDir, "error", err)
+		}
+	}
+	return recursions, nil
 }
+
+// Guards the compare and update of base directory mtimes, which are shared between playlists
+var baseDirMu sync.Mutex
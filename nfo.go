@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"time"
+)
+
+// NFO profiles. Movie writes every item as a movie, episode writes every item
+// as an episode and the playlist directory as a TV show.
+const (
+	nfoMovie   = "movie"
+	nfoEpisode = "episode"
+)
+
+// Name of the nfo file of a playlist directory with the episode profile
+const tvshowNFO = "tvshow.nfo"
+
+type NFO struct {
+	XMLName   xml.Name `xml:"movie"`
+	Title     string   `xml:"title"`
+	SortTitle string   `xml:"sorttitle"`
+	Plot      string   `xml:"plot"`
+	Thumb     string   `xml:"thumb"`
+	Runtime   int      `xml:"runtime,omitempty"`
+	Tag       string   `xml:"tag"`
+}
+
+type EpisodeNFO struct {
+	XMLName   xml.Name  `xml:"episodedetails"`
+	Title     string    `xml:"title"`
+	ShowTitle string    `xml:"showtitle"`
+	Season    int       `xml:"season"`
+	Episode   int       `xml:"episode"`
+	Aired     string    `xml:"aired"`
+	Plot      string    `xml:"plot"`
+	Thumb     string    `xml:"thumb"`
+	Runtime   int       `xml:"runtime,omitempty"`
+	UniqueID  *UniqueID `xml:"uniqueid,omitempty"`
+	Tag       string    `xml:"tag"`
+}
+
+type UniqueID struct {
+	Type    string `xml:"type,attr"`
+	Default bool   `xml:"default,attr"`
+	Value   string `xml:",chardata"`
+}
+
+type TVShowNFO struct {
+	XMLName xml.Name `xml:"tvshow"`
+	Title   string   `xml:"title"`
+	Plot    string   `xml:"plot"`
+	Thumb   *Thumb   `xml:"thumb,omitempty"`
+	Tag     string   `xml:"tag"`
+}
+
+type Thumb struct {
+	Aspect string `xml:"aspect,attr,omitempty"`
+	Value  string `xml:",chardata"`
+}
+
+// Write the nfo file of an item in the playlist with the given name, according to the nfo profile
+func createItemNFO(nfofile string, item PlaylistItem, name string, options Options) error {
+	switch options.nfo {
+	case nfoEpisode:
+		return createEpisodeNFO(nfofile, item, name)
+	default:
+		return createNFO(nfofile, item.title, item.sorttitle, item.description, item.iconUrl, name, item.time, runtime(item.duration))
+	}
+}
+
+// Runtime in minutes as in nfo files, rounded up so that short items have one
+func runtime(duration time.Duration) int {
+	return int((duration + time.Minute - 1) / time.Minute)
+}
+
+func createNFO(nfofile, title, sorttitle, description, iconUrl, tag string, t time.Time, minutes int) error {
+	movie := NFO{
+		Title:     title,
+		SortTitle: sorttitle,
+		Plot:      description,
+		Thumb:     iconUrl,
+		Runtime:   minutes,
+		Tag:       tag,
+	}
+	return writeXML(nfofile, movie, t)
+}
+
+// Episodes are numbered by publish date, the season is the year and the
+// episode is the month, day, hour and minute, so that numbers are stable
+// across runs and ordered by publish time
+func createEpisodeNFO(nfofile string, item PlaylistItem, showTitle string) error {
+	t := item.time.UTC()
+	episode := EpisodeNFO{
+		Title:     item.title,
+		ShowTitle: showTitle,
+		Season:    t.Year(),
+		Episode:   int(t.Month())*1000000 + t.Day()*10000 + t.Hour()*100 + t.Minute(),
+		Aired:     t.Format(time.DateOnly),
+		Plot:      item.description,
+		Thumb:     item.iconUrl,
+		Runtime:   runtime(item.duration),
+		Tag:       showTitle,
+	}
+	if len(item.id) > 0 {
+		episode.UniqueID = &UniqueID{Type: item.source, Default: true, Value: item.id}
+	}
+	return writeXML(nfofile, episode, item.time)
+}
+
+// Write the tvshow.nfo of a playlist directory. The poster is the local
+// poster.jpg if the directory has one, or else the remote feed image.
+func createTVShowNFO(nfofile, title string, info PlaylistInfo, poster bool, t time.Time) error {
+	show := TVShowNFO{
+		Title: title,
+		Plot:  info.description,
+		Tag:   title,
+	}
+	if poster {
+		show.Thumb = &Thumb{Aspect: "poster", Value: posterFile}
+	} else if len(info.imageUrl) > 0 {
+		show.Thumb = &Thumb{Aspect: "poster", Value: info.imageUrl}
+	}
+	return writeXML(nfofile, show, t)
+}
+
+func writeXML(file string, v any, t time.Time) error {
+	var buf bytes.Buffer
+	encoder := xml.NewEncoder(&buf)
+
+	_, err := buf.WriteString(xml.Header)
+	if err != nil {
+		return err
+	}
+
+	err = encoder.Encode(v)
+	if err != nil {
+		return err
+	}
+
+	return output.WriteFile(file, buf.Bytes(), t)
+}
+
+func validateNFOProfile(profile string) error {
+	switch profile {
+	case nfoMovie, nfoEpisode:
+		return nil
+	default:
+		return fmt.Errorf("unknown nfo profile %s, expected %s or %s", profile, nfoMovie, nfoEpisode)
+	}
+}
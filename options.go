@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	url2 "net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options are settings that can be given globally, with flags, and be
+// overridden per stanza entry in the url fragment, for example
+// https://www.youtube.com/channel/UC...#p&maxage=30d&maxitems=50&refresh=6h&nfo=episode&strm=tubed
+//
+// Values in the fragment may be percent encoded, as a filter such as
+// exclude=%23shorts needs to be.
+type Options struct {
+	maxAge   time.Duration
+	maxItems int
+	refresh  time.Duration
+	nfo      string
+	// Flags of the channel sections to parse, p for playlists and r for releases
+	sections string
+	// Strm profile per source name, the empty name is for all sources
+	strm map[string]string
+	// DMS resources per source name, the empty name is for all sources
+	dms map[string]string
+	// Whether to download item thumbnails next to the .strm
+	thumbs bool
+	// Whether to download the poster, fanart and banner of the playlist directory
+	artwork bool
+	// Filter of the items to write
+	filter Filter
+}
+
+var defaultOptions Options
+
+// Split a url fragment into single letter flags, such as p and r, and key=value parameters
+func parseFragment(url string) (string, url2.Values) {
+	flags := ""
+	params := make(url2.Values)
+	i := strings.LastIndex(url, "#")
+	if i < 0 {
+		return flags, params
+	}
+	for _, part := range strings.Split(url[i+1:], "&") {
+		key, value, found := strings.Cut(part, "=")
+		if found {
+			if unescaped, err := url2.QueryUnescape(value); err == nil {
+				value = unescaped
+			}
+			params.Add(strings.ToLower(key), value)
+		} else {
+			flags += part
+		}
+	}
+	return flags, params
+}
+
+// The url without its fragment, as it is fetched
+func stripFragment(url string) string {
+	url, _, _ = strings.Cut(url, "#")
+	return url
+}
+
+// Options for a stanza entry, the parameters in the url fragment override the given options
+func (options Options) forUrl(url string) (Options, error) {
+	flags, params := parseFragment(url)
+	options.sections += flags
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var errs []string
+	for _, key := range keys {
+		values := params[key]
+		err := options.set(key, values[len(values)-1])
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("invalid option %s in url: %v", key, err))
+		}
+	}
+	if len(errs) > 0 {
+		return options, errors.New(strings.Join(errs, "; "))
+	}
+	return options, nil
+}
+
+func (options *Options) set(key, value string) error {
+	var err error
+	switch key {
+	case "maxage":
+		options.maxAge, err = parseAge(value)
+	case "maxitems":
+		options.maxItems, err = strconv.Atoi(value)
+	case "refresh":
+		options.refresh, err = parseAge(value)
+	case "nfo":
+		err = validateNFOProfile(value)
+		if err == nil {
+			options.nfo = value
+		}
+	case "strm":
+		options.strm, err = parseStrmProfiles(value, options.strm)
+	case "thumbs":
+		options.thumbs, err = strconv.ParseBool(value)
+	case "artwork":
+		options.artwork, err = strconv.ParseBool(value)
+	case "dms":
+		options.dms, err = setDmsSpec("", value, options.dms)
+	case "include", "exclude", "author", "after", "before":
+		err = options.filter.set(key, value)
+	default:
+		if source, ok := strings.CutPrefix(key, "strm."); ok && sourceByName(source) != nil {
+			options.strm, err = parseStrmProfiles(source+"="+value, options.strm)
+			break
+		}
+		if source, ok := strings.CutPrefix(key, "dms."); ok && sourceByName(source) != nil {
+			options.dms, err = setDmsSpec(source, value, options.dms)
+			break
+		}
+		err = fmt.Errorf("unknown option %s", key)
+	}
+	return err
+}
+
+// Fingerprint of the options that change what is written for a feed, so
+// that a feed is written again when they change even if it has not changed
+func (options Options) fingerprint() string {
+	filter := options.filter
+	var regexes []string
+	for _, re := range []*regexp.Regexp{filter.include, filter.exclude, filter.author} {
+		if re != nil {
+			regexes = append(regexes, re.String())
+		} else {
+			regexes = append(regexes, "")
+		}
+	}
+	// Maps are printed sorted by key. The DMS defaults are included, as they
+	// are rendered into files that are otherwise only rewritten when the feed changes.
+	s := fmt.Sprintf("%v|%v|%v|%v|%v|%v|%v|%v|%v|%q|%v|%v|%v", options.maxAge, options.maxItems, options.nfo, options.sections,
+		options.strm, options.dms, dmsDefaults, options.thumbs, options.artwork, regexes, filter.after, filter.before, resolverUrl)
+	sum := sha1.Sum([]byte(s))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Parse an age such as 72h, 30d or 2w. An empty age or 0 means no limit
+func parseAge(age string) (time.Duration, error) {
+	if len(age) == 0 || age == "0" {
+		return 0, nil
+	}
+	unit := time.Duration(0)
+	switch {
+	case strings.HasSuffix(age, "d"):
+		unit = 24 * time.Hour
+	case strings.HasSuffix(age, "w"):
+		unit = 7 * 24 * time.Hour
+	default:
+		return time.ParseDuration(age)
+	}
+	n, err := strconv.ParseFloat(age[:len(age)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid age %s", age)
+	}
+	return time.Duration(n * float64(unit)), nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		age  string
+		want time.Duration
+	}{
+		{"", 0},
+		{"0", 0},
+		{"72h", 72 * time.Hour},
+		{"90m", 90 * time.Minute},
+		{"30d", 30 * 24 * time.Hour},
+		{"1.5d", 36 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+	}
+	for _, test := range tests {
+		got, err := parseAge(test.age)
+		if err != nil || got != test.want {
+			t.Errorf("parseAge(%q) = %v, %v, want %v", test.age, got, err, test.want)
+		}
+	}
+	for _, age := range []string{"abc", "xd", "3y"} {
+		if _, err := parseAge(age); err == nil {
+			t.Errorf("parseAge(%q): no error", age)
+		}
+	}
+}
+
+func TestParseFragment(t *testing.T) {
+	flags, params := parseFragment("https://www.youtube.com/channel/UC#p&r&MaxItems=5&exclude=%23shorts")
+	if flags != "pr" || params.Get("maxitems") != "5" || params.Get("exclude") != "#shorts" {
+		t.Errorf("parseFragment = %q, %v", flags, params)
+	}
+	flags, params = parseFragment("https://example.com/feed.xml")
+	if flags != "" || len(params) != 0 {
+		t.Errorf("parseFragment without fragment = %q, %v", flags, params)
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	var a, b Options
+	if a.fingerprint() != b.fingerprint() {
+		t.Error("equal options have different fingerprints")
+	}
+	b.set("nfo", nfoEpisode)
+	if a.fingerprint() == b.fingerprint() {
+		t.Error("nfo does not change the fingerprint")
+	}
+	a.set("nfo", nfoEpisode)
+	a.set("refresh", "6h")
+	if a.fingerprint() != b.fingerprint() {
+		t.Error("refresh changes the fingerprint")
+	}
+	a.set("exclude", "#shorts")
+	if a.fingerprint() == b.fingerprint() {
+		t.Error("filter does not change the fingerprint")
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Output is where playlists are written. The disk output writes to the file
+// system, the plan output only records what would change.
+type Output interface {
+	MkdirAll(dir string) error
+	// WriteFile writes the file and sets its mtime
+	WriteFile(file string, data []byte, t time.Time) error
+	Remove(path string) error
+	Chtimes(path string, t time.Time) error
+	ReadDir(dir string) ([]OutputEntry, error)
+	ModTime(path string) (time.Time, error)
+}
+
+// An entry in an output directory
+type OutputEntry struct {
+	name    string
+	dir     bool
+	modTime time.Time
+}
+
+var output Output = diskOutput{}
+
+// Whether the run is only planning, in which case no state is written either
+var planning bool
+
+// The disk output only writes files whose content differs from what is on
+// disk, and only sets mtimes that differ. Changes are recorded in the log,
+// if any.
+type diskOutput struct {
+	log *changeLog
+}
+
+func (diskOutput) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, os.ModePerm)
+}
+
+func (d diskOutput) WriteFile(file string, data []byte, t time.Time) error {
+	err := d.writeFile(file, file, data)
+	if err != nil {
+		return err
+	}
+	return d.Chtimes(file, t)
+}
+
+// Write the file, recording the change as a change to logFile
+func (d diskOutput) writeFile(file, logFile string, data []byte) error {
+	action, err := compareFile(file, data)
+	if err != nil {
+		return err
+	}
+	if action != actionUnchanged {
+		err = replaceFile(file, data)
+		if err != nil {
+			return err
+		}
+	}
+	d.log.record(action, logFile)
+	return nil
+}
+
+// Replace the file through a temporary file, so that it is never seen half
+// written and so that other links to the old file are left as they are. All
+// files are written this way, output as well as state.
+func replaceFile(file string, data []byte) error {
+	dir, name := filepath.Split(file)
+	tmp, err := os.CreateTemp(dir, "."+name+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// Whether writing the data to the file would create, update or leave it unchanged
+func compareFile(file string, data []byte) (string, error) {
+	info, err := os.Stat(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return actionCreate, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if info.Size() != int64(len(data)) {
+		return actionUpdate, nil
+	}
+	existing, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Equal(existing, data) {
+		return actionUnchanged, nil
+	}
+	return actionUpdate, nil
+}
+
+func (d diskOutput) Remove(path string) error {
+	return d.remove(path, path)
+}
+
+// Remove the path, recording the change as a change to logPath
+func (d diskOutput) remove(path, logPath string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err == nil && !info.IsDir() {
+		d.log.record(actionDelete, logPath)
+	}
+	return err
+}
+
+// Set the mtime, unless it already is the given time to the second
+func (diskOutput) Chtimes(path string, t time.Time) error {
+	info, err := os.Stat(path)
+	if err == nil && info.ModTime().Truncate(time.Second).Equal(t.Truncate(time.Second)) {
+		return nil
+	}
+	return os.Chtimes(path, t, t)
+}
+
+func (diskOutput) ModTime(path string) (time.Time, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (diskOutput) ReadDir(dir string) ([]OutputEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	outputEntries := make([]OutputEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		outputEntries = append(outputEntries, OutputEntry{name: entry.Name(), dir: entry.IsDir(), modTime: info.ModTime()})
+	}
+	return outputEntries, nil
+}
+
+// Change actions
+const (
+	actionCreate    = "create"
+	actionUpdate    = "update"
+	actionDelete    = "delete"
+	actionUnchanged = "unchanged"
+)
+
+type Change struct {
+	Action string `json:"action"`
+	File   string `json:"file"`
+}
+
+// The changes to the files of a playlist directory
+type PlaylistChanges struct {
+	Prefix    string   `json:"prefix"`
+	Playlist  string   `json:"playlist"`
+	Changes   []Change `json:"changes"`
+	Created   int      `json:"created"`
+	Updated   int      `json:"updated"`
+	Deleted   int      `json:"deleted"`
+	Unchanged int      `json:"unchanged"`
+}
+
+// Changes to files in playlist directories, grouped by prefix and playlist
+type changeLog struct {
+	mu             sync.Mutex
+	destinationDir string
+	playlists      map[string]*PlaylistChanges
+}
+
+func newChangeLog(destinationDir string) *changeLog {
+	return &changeLog{
+		destinationDir: filepath.Clean(destinationDir),
+		playlists:      make(map[string]*PlaylistChanges),
+	}
+}
+
+// Record a change to a file, grouped by prefix and playlist directory
+func (c *changeLog) record(action, file string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir, name := filepath.Split(filepath.Clean(file))
+	dir = filepath.Clean(dir)
+	changes, ok := c.playlists[dir]
+	if !ok {
+		rel, err := filepath.Rel(c.destinationDir, dir)
+		if err != nil {
+			rel = dir
+		}
+		prefix, playlist, _ := strings.Cut(filepath.ToSlash(rel), "/")
+		changes = &PlaylistChanges{Prefix: prefix, Playlist: playlist}
+		c.playlists[dir] = changes
+	}
+	switch action {
+	case actionCreate:
+		changes.Created++
+	case actionUpdate:
+		changes.Updated++
+	case actionDelete:
+		changes.Deleted++
+	case actionUnchanged:
+		changes.Unchanged++
+		return
+	}
+	changes.Changes = append(changes.Changes, Change{Action: action, File: name})
+}
+
+// The changes per playlist, sorted by prefix and playlist
+func (c *changeLog) changes() []*PlaylistChanges {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	changes := make([]*PlaylistChanges, 0, len(c.playlists))
+	for _, pc := range c.playlists {
+		changes = append(changes, pc)
+	}
+	slices.SortFunc(changes, func(a, b *PlaylistChanges) int {
+		if c := strings.Compare(a.Prefix, b.Prefix); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Playlist, b.Playlist)
+	})
+	return changes
+}
+
+// Take the changes of a playlist directory out of the log
+func (c *changeLog) take(dir string) (PlaylistChanges, bool) {
+	if c == nil {
+		return PlaylistChanges{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir = filepath.Clean(dir)
+	changes, ok := c.playlists[dir]
+	if !ok {
+		return PlaylistChanges{}, false
+	}
+	delete(c.playlists, dir)
+	return *changes, true
+}
+
+// Log the counts of the files created, updated, deleted and left unchanged in
+// a playlist directory since it was last logged
+func logPlaylistChanges(dir string) {
+	var log *changeLog
+	switch o := output.(type) {
+	case diskOutput:
+		log = o.log
+	case *stagedOutput:
+		log = o.log
+	}
+	changes, ok := log.take(dir)
+	if !ok {
+		return
+	}
+	slog.Info("Wrote playlist", "prefix", changes.Prefix, "playlist", changes.Playlist,
+		"created", changes.Created, "updated", changes.Updated, "deleted", changes.Deleted, "unchanged", changes.Unchanged)
+}
+
+// Planned state of a path, overlaying the file system
+type plannedPath struct {
+	removed bool
+	dir     bool
+	modTime time.Time
+}
+
+// The plan output compares what would be written with what is on disk, and
+// keeps the planned changes as an overlay so that retention and reconcile see
+// the planned state
+type planOutput struct {
+	mu    sync.Mutex
+	paths map[string]plannedPath
+	*changeLog
+}
+
+func newPlanOutput(destinationDir string) *planOutput {
+	return &planOutput{
+		paths:     make(map[string]plannedPath),
+		changeLog: newChangeLog(destinationDir),
+	}
+}
+
+func (p *planOutput) exists(path string) (bool, error) {
+	if planned, ok := p.paths[path]; ok {
+		return !planned.removed, nil
+	}
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (p *planOutput) MkdirAll(dir string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for d := filepath.Clean(dir); ; d = filepath.Dir(d) {
+		exists, err := p.exists(d)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return nil
+		}
+		p.paths[d] = plannedPath{dir: true}
+		if parent := filepath.Dir(d); parent == d {
+			return nil
+		}
+	}
+}
+
+func (p *planOutput) WriteFile(file string, data []byte, t time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	file = filepath.Clean(file)
+	planned, wasPlanned := p.paths[file]
+	p.paths[file] = plannedPath{modTime: t}
+	if wasPlanned && !planned.removed {
+		// Written twice in the same run, the first write has been recorded
+		return nil
+	}
+	existing, err := os.ReadFile(file)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		p.record(actionCreate, file)
+	case err != nil:
+		return err
+	case bytes.Equal(existing, data):
+		p.record(actionUnchanged, file)
+	default:
+		p.record(actionUpdate, file)
+	}
+	return nil
+}
+
+func (p *planOutput) Remove(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	path = filepath.Clean(path)
+	exists, err := p.exists(path)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return &fs.PathError{Op: "remove", Path: path, Err: fs.ErrNotExist}
+	}
+	planned := p.paths[path]
+	p.paths[path] = plannedPath{removed: true}
+	if !planned.dir {
+		info, err := os.Stat(path)
+		if err == nil && info.IsDir() {
+			return nil
+		}
+		p.record(actionDelete, path)
+	}
+	return nil
+}
+
+func (p *planOutput) Chtimes(path string, t time.Time) error {
+	return nil
+}
+
+func (p *planOutput) ModTime(path string) (time.Time, error) {
+	p.mu.Lock()
+	planned, ok := p.paths[filepath.Clean(path)]
+	p.mu.Unlock()
+	if !ok {
+		return diskOutput{}.ModTime(path)
+	}
+	if planned.removed {
+		return time.Time{}, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrNotExist}
+	}
+	return planned.modTime, nil
+}
+
+func (p *planOutput) ReadDir(dir string) ([]OutputEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dir = filepath.Clean(dir)
+
+	entries := make(map[string]OutputEntry)
+	diskEntries, err := diskOutput{}.ReadDir(dir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err != nil {
+		if planned, ok := p.paths[dir]; !ok || planned.removed {
+			return nil, err
+		}
+	}
+	for _, entry := range diskEntries {
+		entries[entry.name] = entry
+	}
+	for path, planned := range p.paths {
+		if filepath.Dir(path) != dir {
+			continue
+		}
+		name := filepath.Base(path)
+		if planned.removed {
+			delete(entries, name)
+		} else {
+			entries[name] = OutputEntry{name: name, dir: planned.dir, modTime: planned.modTime}
+		}
+	}
+
+	outputEntries := make([]OutputEntry, 0, len(entries))
+	for _, entry := range entries {
+		outputEntries = append(outputEntries, entry)
+	}
+	slices.SortFunc(outputEntries, func(a, b OutputEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return outputEntries, nil
+}
+
+// Formats of the plan report
+const (
+	planTable = "table"
+	planJson  = "json"
+)
+
+func validatePlanFormat(format string) error {
+	switch format {
+	case planTable, planJson:
+		return nil
+	default:
+		return fmt.Errorf("unknown plan format %s, expected %s or %s", format, planTable, planJson)
+	}
+}
+
+// Write the plan as a table or as JSON
+func (p *planOutput) report(w io.Writer, format string) error {
+	changes := p.changes()
+	if format == planJson {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(changes)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PREFIX\tPLAYLIST\tACTION\tFILE")
+	for _, c := range changes {
+		for _, change := range c.Changes {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", c.Prefix, c.Playlist, change.Action, change.File)
+		}
+	}
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "PREFIX\tPLAYLIST\tCREATED\tUPDATED\tDELETED\tUNCHANGED")
+	for _, c := range changes {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%d\t%d\n", c.Prefix, c.Playlist, c.Created, c.Updated, c.Deleted, c.Unchanged)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Reconcile modes. Plan lists the orphaned output, apply lists and removes it.
+const (
+	reconcilePlan  = "plan"
+	reconcileApply = "apply"
+)
+
+// The output produced in a run. Files written in the run are backed by a
+// stanza entry and a feed item, as are the files of items in the history of
+// a feed. Directories of entries that could not be
+// refreshed, because they failed or were not modified, are kept as they are.
+type outputSet struct {
+	mu       sync.Mutex
+	files    map[string]bool
+	keptDirs map[string]bool
+}
+
+var produced outputSet
+
+func (o *outputSet) addFile(file string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.files == nil {
+		o.files = make(map[string]bool)
+	}
+	o.files[filepath.Clean(file)] = true
+}
+
+func (o *outputSet) keepDir(dir string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.keptDirs == nil {
+		o.keptDirs = make(map[string]bool)
+	}
+	o.keptDirs[filepath.Clean(dir)] = true
+}
+
+// Back the files of the items in the history of a feed written to dir, so
+// that items which only dropped out of the feed are not reconciled away.
+// Items dropped by the filter are not backed.
+func (o *outputSet) addHistory(dir, feedUrl string, filter Filter) error {
+	history, err := loadHistory(feedUrl)
+	if err != nil {
+		return err
+	}
+	for _, historyItem := range history.Items {
+		if len(historyItem.FileName) == 0 {
+			continue
+		}
+		if _, drops := filter.drops(historyItem.playlistItem()); drops {
+			continue
+		}
+		for _, ext := range itemExtensions {
+			o.addFile(filepath.Join(dir, historyItem.FileName+ext))
+		}
+	}
+	return nil
+}
+
+// Whether the path is in, or is, a kept directory
+func (o *outputSet) inKeptDir(path string) bool {
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if o.keptDirs[dir] {
+			return true
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return false
+		}
+	}
+}
+
+// Find the files and directories under root that are not backed by the
+// output of the run, deepest first
+func (o *outputSet) orphans(root string) ([]string, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	root = filepath.Clean(root)
+
+	// Directories holding backed output
+	neededDirs := make(map[string]bool)
+	for _, paths := range []map[string]bool{o.files, o.keptDirs} {
+		for path := range paths {
+			for dir := filepath.Dir(path); isWithin(dir, root) && !neededDirs[dir]; dir = filepath.Dir(dir) {
+				neededDirs[dir] = true
+			}
+		}
+	}
+
+	var orphans []string
+	state := filepath.Clean(stateDir)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		if path == state {
+			return filepath.SkipDir
+		}
+		if o.inKeptDir(path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if !neededDirs[path] {
+				orphans = append(orphans, path)
+			}
+			return nil
+		}
+		if !o.files[path] {
+			orphans = append(orphans, path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the contents of a directory before the directory itself
+	slices.Reverse(orphans)
+	return orphans, nil
+}
+
+func isWithin(path, root string) bool {
+	return path == root || strings.HasPrefix(path, root+string(filepath.Separator))
+}
+
+// The directories to reconcile, the prefix directory under the destination
+// of each entry. Roots within another root are reconciled with it.
+func reconcileRoots(entries []Entry, destinationDir, prefix string) []string {
+	roots := []string{filepath.Clean(destinationDir + "/" + prefix)}
+	for _, entry := range entries {
+		if len(entry.destinationDir) > 0 {
+			roots = append(roots, filepath.Clean(entry.destinationDir+"/"+prefix))
+		}
+	}
+	slices.Sort(roots)
+	roots = slices.Compact(roots)
+	// Sorted, the roots a root is within come before it
+	var outer []string
+	for _, root := range roots {
+		if !slices.ContainsFunc(outer, func(o string) bool { return isWithin(root, o) }) {
+			outer = append(outer, root)
+		}
+	}
+	return outer
+}
+
+// List, and with apply remove, the output under root that is no longer backed
+// by any stanza entry or feed item
+func reconcile(root string, mode string) error {
+	orphans, err := produced.orphans(root)
+	if err != nil {
+		return err
+	}
+	slog.Info("Reconciling output", "directory", root, "mode", mode, "orphans", len(orphans))
+	for _, orphan := range orphans {
+		if planning {
+			// Recorded as deleted in the plan
+			err := output.Remove(orphan)
+			if err != nil && !os.IsNotExist(err) {
+				slog.Error("Could not plan removal of orphaned output", "path", orphan, "error", err)
+			}
+			continue
+		}
+		// Listed on standard error, as standard output may carry a report
+		if mode != reconcileApply {
+			fmt.Fprintf(os.Stderr, "would remove %s\n", orphan)
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "removing %s\n", orphan)
+		err := output.Remove(orphan)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("Could not remove orphaned output", "path", orphan, "error", err)
+		}
+	}
+	return nil
+}
+
+func validateReconcileMode(mode string) error {
+	switch mode {
+	case "", reconcilePlan, reconcileApply:
+		return nil
+	default:
+		return fmt.Errorf("unknown reconcile mode %s, expected %s or %s", mode, reconcilePlan, reconcileApply)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"regexp"
+
+	"github.com/mmcdole/gofeed"
+)
+
+var redditRegex = regexp.MustCompile(`reddit.com\/r\/([^/]+)`)
+
+// Subreddit feeds. The videos in a subreddit are linked from the post
+// contents and are mapped to streams by the source hosting them.
+type redditSource struct{}
+
+func (redditSource) Name() string {
+	return "reddit"
+}
+
+func (redditSource) Match(url string) bool {
+	return redditRegex.MatchString(url)
+}
+
+func (redditSource) Parse(title, url, destinationDir, prefix string, parseChannelPlaylists bool, options Options) error {
+	subreddit := redditRegex.FindStringSubmatch(url)[1]
+	slog.Debug("Subreddit detected", "subreddit", subreddit)
+	return parseAndWritePlaylists(title, fmt.Sprintf("https://www.reddit.com/r/%s/.rss", subreddit), destinationDir, prefix, options)
+}
+
+// The icon and banners of the subreddit, from its about.json
+func (redditSource) Artwork(feedUrl string, info PlaylistInfo) (FolderArtwork, bool) {
+	matches := redditRegex.FindStringSubmatch(feedUrl)
+	if len(matches) == 0 {
+		return FolderArtwork{}, false
+	}
+	body, err := client.get(fmt.Sprintf("https://www.reddit.com/r/%s/about.json", matches[1]), nil)
+	if err != nil {
+		slog.Warn("Could not fetch subreddit about for artwork", "subreddit", matches[1], "error", err)
+		return FolderArtwork{}, true
+	}
+	var about struct {
+		Data struct {
+			CommunityIcon         string `json:"community_icon"`
+			IconImg               string `json:"icon_img"`
+			BannerImg             string `json:"banner_img"`
+			BannerBackgroundImage string `json:"banner_background_image"`
+			MobileBannerImage     string `json:"mobile_banner_image"`
+		} `json:"data"`
+	}
+	err = json.Unmarshal(body, &about)
+	if err != nil {
+		slog.Warn("Could not parse subreddit about for artwork", "subreddit", matches[1], "error", err)
+		return FolderArtwork{}, true
+	}
+	// Reddit html escapes the urls in about.json
+	artwork := FolderArtwork{
+		poster: html.UnescapeString(cmp.Or(about.Data.CommunityIcon, about.Data.IconImg)),
+		fanart: html.UnescapeString(about.Data.BannerBackgroundImage),
+		banner: html.UnescapeString(cmp.Or(about.Data.BannerImg, about.Data.MobileBannerImage)),
+	}
+	return artwork, true
+}
+
+func (redditSource) Stream(item *gofeed.Item) (Stream, bool) {
+	return Stream{}, false
+}
+
+func (redditSource) Recurse(item PlaylistItem) (string, bool) {
+	return "", false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Status of an entry or a feed in the run report
+const (
+	statusWritten   = "written"
+	statusUnchanged = "unchanged"
+	statusEmpty     = "empty"
+	statusFailed    = "failed"
+)
+
+// Summary of a run, one report per stanza or config entry
+type RunReport struct {
+	Started  time.Time     `json:"started"`
+	Duration float64       `json:"durationSeconds"`
+	Entries  []EntryReport `json:"entries"`
+	Total    int           `json:"total"`
+	Failed   int           `json:"failed"`
+
+	mu sync.Mutex
+	// Feeds written by the run, by playlist directory
+	feeds map[string]FeedReport
+}
+
+// Outcome of an entry. An entry is failed if it or any of the feeds it
+// resolved to, such as the playlists of a channel, failed.
+type EntryReport struct {
+	Title     string       `json:"title"`
+	Url       string       `json:"url"`
+	Directory string       `json:"directory"`
+	Status    string       `json:"status"`
+	Items     int          `json:"items"`
+	New       int          `json:"new"`
+	Error     string       `json:"error,omitempty"`
+	Duration  float64      `json:"durationSeconds"`
+	Feeds     []FeedReport `json:"feeds"`
+}
+
+// Outcome of a feed an entry resolved to
+type FeedReport struct {
+	Url       string `json:"url"`
+	Directory string `json:"directory"`
+	Status    string `json:"status"`
+	Items     int    `json:"items"`
+	// Items not seen in earlier runs, as recorded in the item history
+	New   int    `json:"new"`
+	Error string `json:"error,omitempty"`
+}
+
+// The report of the current run, nil when not reporting, as when serving
+var runReport *RunReport
+
+func newRunReport() *RunReport {
+	return &RunReport{Started: time.Now(), feeds: make(map[string]FeedReport)}
+}
+
+// Record the outcome of a feed written to a playlist directory
+func (r *RunReport) feed(dir, url, status string, items int, err error) {
+	if r == nil {
+		return
+	}
+	dir = filepath.Clean(dir)
+	feed := FeedReport{Url: url, Directory: dir, Status: status, Items: items}
+	if err != nil {
+		feed.Status = statusFailed
+		feed.Error = err.Error()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.feeds[dir] = feed
+}
+
+// Record the number of items of a feed not seen in earlier runs
+func (r *RunReport) newItems(dir string, n int) {
+	if r == nil {
+		return
+	}
+	dir = filepath.Clean(dir)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	feed := r.feeds[dir]
+	feed.New = n
+	r.feeds[dir] = feed
+}
+
+// The number of items in a playlist directory
+func countItems(dir string) int {
+	entries, err := output.ReadDir(dir)
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, entry := range entries {
+		if !entry.dir && strings.HasSuffix(entry.name, ".strm") {
+			n++
+		}
+	}
+	return n
+}
+
+// Record the outcome of an entry, with the feeds written under its directory
+func (r *RunReport) entry(entry Entry, dir string, duration time.Duration, err error) {
+	dir = filepath.Clean(dir)
+	report := EntryReport{Title: entry.title, Url: entry.url, Directory: dir, Duration: duration.Seconds(), Feeds: []FeedReport{}}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for feedDir, feed := range r.feeds {
+		if isWithin(feedDir, dir) {
+			report.Feeds = append(report.Feeds, feed)
+		}
+	}
+	slices.SortFunc(report.Feeds, func(a, b FeedReport) int {
+		return strings.Compare(a.Directory, b.Directory)
+	})
+
+	var errs []string
+	report.Status = statusEmpty
+	for _, feed := range report.Feeds {
+		report.Items += feed.Items
+		report.New += feed.New
+		switch {
+		case feed.Status == statusFailed:
+			errs = append(errs, feed.Url+": "+feed.Error)
+		case feed.Status == statusWritten:
+			report.Status = statusWritten
+		case feed.Status == statusUnchanged && report.Status == statusEmpty:
+			report.Status = statusUnchanged
+		}
+	}
+	// The error of the entry is usually that of its failed feed
+	if err != nil && len(errs) == 0 {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		report.Status = statusFailed
+		report.Error = strings.Join(errs, "; ")
+		r.Failed++
+	}
+	r.Total++
+	r.Entries = append(r.Entries, report)
+}
+
+// Whether more entries failed than allowed
+func (r *RunReport) exceeds(maxFailures func(total int) int) bool {
+	return r.Failed > maxFailures(r.Total)
+}
+
+func (r *RunReport) finish() {
+	r.Duration = time.Since(r.Started).Seconds()
+	slices.SortFunc(r.Entries, func(a, b EntryReport) int {
+		return strings.Compare(a.Directory, b.Directory)
+	})
+}
+
+// Write the report as JSON to the file, or to standard output if it is -
+func (r *RunReport) write(filename string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if filename == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return writeStateFile(filename, data)
+}
+
+// Run the entries, reporting the outcome of each
+func runPlaylists(entries []Entry, destinationDir string, prefix string, parseChannelPlaylists bool) *RunReport {
+	report := newRunReport()
+	runReport = report
+	defer func() { runReport = nil }()
+
+	var wg sync.WaitGroup
+	for _, entry := range entries {
+		runWorker(&wg, func() {
+			start := time.Now()
+			err := parsePlaylist(entry, destinationDir, prefix, parseChannelPlaylists)
+			report.entry(entry, entryDir(entry, destinationDir, prefix), time.Since(start), err)
+		})
+	}
+	wg.Wait()
+	report.finish()
+	slog.Info("Run complete", "entries", report.Total, "failed", report.Failed, "duration", time.Since(report.Started))
+	return report
+}
+
+// Maximum number of failed entries, a count or a percentage of the entries
+func parseMaxFailures(s string) (func(total int) int, error) {
+	if percent, ok := strings.CutSuffix(s, "%"); ok {
+		p, err := strconv.ParseFloat(percent, 64)
+		if err != nil || p < 0 || p > 100 {
+			return nil, fmt.Errorf("invalid max failures %q, must be a count or a percentage", s)
+		}
+		return func(total int) int { return int(float64(total) * p / 100) }, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid max failures %q, must be a count or a percentage", s)
+	}
+	return func(int) int { return n }, nil
+}
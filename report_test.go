@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestParseMaxFailures(t *testing.T) {
+	tests := []struct {
+		value   string
+		total   int
+		allowed int
+	}{
+		{"0", 10, 0},
+		{"3", 10, 3},
+		{"3", 0, 3},
+		{"10%", 10, 1},
+		{"10%", 25, 2},
+		{"50%", 3, 1},
+		{"100%", 7, 7},
+		{"0%", 7, 0},
+	}
+	for _, test := range tests {
+		maxFailures, err := parseMaxFailures(test.value)
+		if err != nil {
+			t.Errorf("parseMaxFailures(%q): %v", test.value, err)
+			continue
+		}
+		if got := maxFailures(test.total); got != test.allowed {
+			t.Errorf("parseMaxFailures(%q)(%d) = %d, want %d", test.value, test.total, got, test.allowed)
+		}
+	}
+	for _, value := range []string{"", "-1", "abc", "101%", "-5%", "x%"} {
+		if _, err := parseMaxFailures(value); err == nil {
+			t.Errorf("parseMaxFailures(%q): no error", value)
+		}
+	}
+}
+
+func TestRunReportExceeds(t *testing.T) {
+	report := &RunReport{Total: 10, Failed: 2}
+	allowOne, _ := parseMaxFailures("1")
+	allowTwo, _ := parseMaxFailures("20%")
+	if !report.exceeds(allowOne) {
+		t.Error("2 failures should exceed 1")
+	}
+	if report.exceeds(allowTwo) {
+		t.Error("2 failures should not exceed 20% of 10")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The resolver is an HTTP endpoint that .strm files can point at, so that
+// any player can play the library. At play time /play/<source>/<id> is
+// resolved to a stream url by an external command, such as yt-dlp, and
+// redirected to.
+type resolver struct {
+	listen   string
+	command  string
+	timeout  time.Duration
+	mu       sync.Mutex
+	resolved map[string]resolvedStream
+}
+
+type resolvedStream struct {
+	url     string
+	expires time.Time
+}
+
+// The arguments available to the resolver command template
+type ResolveData struct {
+	Source string
+	Id     string
+	Url    string
+}
+
+// Stream urls expire, YouTube's after some hours, so they are only reused briefly
+const resolvedTTL = 30 * time.Minute
+
+// Page urls of items by source, from their id
+var resolverPages = map[string]string{
+	"youtube": "https://www.youtube.com/watch?v=%s",
+}
+
+var resolverIdRegex = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9_-]*$`)
+
+// Base url of the resolver as written in .strm files, such as http://host:8080
+var resolverUrl string
+
+func newResolver(listen string, command string, timeout time.Duration) *resolver {
+	return &resolver{listen: listen, command: command, timeout: timeout, resolved: make(map[string]resolvedStream)}
+}
+
+// The base url of a resolver listening on the address, as reachable from other hosts
+func defaultResolverUrl(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	if len(host) == 0 {
+		host, err = os.Hostname()
+		if err != nil {
+			host = "localhost"
+		}
+	}
+	return "http://" + net.JoinHostPort(host, port)
+}
+
+func (r *resolver) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /play/{source}/{id}", r.play)
+	return mux
+}
+
+func (r *resolver) play(w http.ResponseWriter, req *http.Request) {
+	source, id := req.PathValue("source"), req.PathValue("id")
+	page, ok := resolverPages[source]
+	if !ok || !resolverIdRegex.MatchString(id) {
+		http.NotFound(w, req)
+		return
+	}
+	streamUrl, err := r.resolve(req.Context(), ResolveData{Source: source, Id: id, Url: fmt.Sprintf(page, id)})
+	if err != nil {
+		slog.Error("Could not resolve stream", "source", source, "id", id, "error", err)
+		http.Error(w, "could not resolve stream", http.StatusBadGateway)
+		return
+	}
+	slog.Debug("Resolved stream", "source", source, "id", id, "url", streamUrl)
+	http.Redirect(w, req, streamUrl, http.StatusFound)
+}
+
+// Resolve an item to a stream url with the resolver command, reusing recently resolved urls
+func (r *resolver) resolve(ctx context.Context, data ResolveData) (string, error) {
+	key := data.Source + ":" + data.Id
+	r.mu.Lock()
+	stream, ok := r.resolved[key]
+	r.mu.Unlock()
+	if ok && time.Now().Before(stream.expires) {
+		return stream.url, nil
+	}
+
+	args := strings.Fields(r.command)
+	if len(args) == 0 {
+		return "", errors.New("no resolver command")
+	}
+	for i, arg := range args {
+		var err error
+		args[i], err = executeTemplate(arg, data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+
+	// The first url printed, yt-dlp prints one per format when video and audio are separate
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if isUrl(line) {
+			r.mu.Lock()
+			r.resolved[key] = resolvedStream{url: line, expires: time.Now().Add(resolvedTTL)}
+			r.mu.Unlock()
+			return line, nil
+		}
+	}
+	return "", fmt.Errorf("%s printed no stream url", args[0])
+}
+
+// Serve the resolver until the context is done
+func (r *resolver) serve(ctx context.Context) error {
+	server := &http.Server{Addr: r.listen, Handler: r.handler()}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	slog.Info("Resolver listening", "address", r.listen, "url", resolverUrl)
+	err := server.ListenAndServe()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Extensions of the files written for each playlist item
+var itemExtensions = []string{".strm", ".nfo", ".dms.json", thumbSuffix}
+
+// Files written for the playlist directory as a whole, rather than for an item
+var playlistFiles = []string{tvshowNFO, posterFile, fanartFile, bannerFile}
+
+// Keep the items that fall within the retention policy, newest first
+func retainItems(playlist []PlaylistItem, options Options) []PlaylistItem {
+	if options.maxAge <= 0 && options.maxItems <= 0 {
+		return playlist
+	}
+	retained := make([]PlaylistItem, 0, len(playlist))
+	cutoff := time.Now().Add(-options.maxAge)
+	for _, item := range playlist {
+		if options.maxAge > 0 && item.time.Before(cutoff) {
+			slog.Debug("Item older than max age", "title", item.title, "time", item.time, "maxAge", options.maxAge)
+			continue
+		}
+		retained = append(retained, item)
+	}
+	slices.SortStableFunc(retained, func(a, b PlaylistItem) int {
+		return b.time.Compare(a.time)
+	})
+	if options.maxItems > 0 && len(retained) > options.maxItems {
+		retained = retained[:options.maxItems]
+	}
+	return retained
+}
+
+// The item name of a file written for a playlist item, or false if it is some other file
+func itemName(file string) (string, bool) {
+	if slices.Contains(playlistFiles, file) {
+		return "", false
+	}
+	for _, ext := range itemExtensions {
+		if strings.HasSuffix(file, ext) {
+			return strings.TrimSuffix(file, ext), true
+		}
+	}
+	return "", false
+}
+
+// Remove the files of items in the playlist directory that fall outside the
+// retention policy. Items are aged by the mtime of their files, which is set
+// to the item publish time when written. The directory is removed if it ends
+// up empty.
+func applyRetention(dir string, options Options) error {
+	if options.maxAge <= 0 && options.maxItems <= 0 {
+		return nil
+	}
+	entries, err := output.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	itemTimes := make(map[string]time.Time)
+	for _, entry := range entries {
+		if entry.dir {
+			continue
+		}
+		name, ok := itemName(entry.name)
+		if !ok {
+			continue
+		}
+		// The stream file decides the item time if there is one
+		if t, ok := itemTimes[name]; !ok || strings.HasSuffix(entry.name, ".strm") || entry.modTime.After(t) {
+			itemTimes[name] = entry.modTime
+		}
+	}
+
+	names := make([]string, 0, len(itemTimes))
+	for name := range itemTimes {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return itemTimes[b].Compare(itemTimes[a])
+	})
+
+	cutoff := time.Now().Add(-options.maxAge)
+	for i, name := range names {
+		tooOld := options.maxAge > 0 && itemTimes[name].Before(cutoff)
+		tooMany := options.maxItems > 0 && i >= options.maxItems
+		if tooOld || tooMany {
+			slog.Info("Removing item outside retention policy", "directory", dir, "item", name, "time", itemTimes[name])
+			removeItem(dir, name)
+		}
+	}
+	return removeIfEmpty(dir)
+}
+
+func removeItem(dir, name string) {
+	for _, ext := range itemExtensions {
+		file := filepath.Join(dir, name+ext)
+		err := output.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			slog.Error("Could not remove file", "file", file, "error", err)
+		}
+	}
+}
+
+func removeIfEmpty(dir string) error {
+	entries, err := output.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		slog.Info("Removing empty directory", "directory", dir)
+		return output.Remove(dir)
+	}
+	return nil
+}
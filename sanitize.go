@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Maximum length in bytes of a sanitized name. File systems limit names to
+// 255 bytes, this leaves room for collision suffixes and item extensions.
+const maxNameBytes = 200
+
+// Characters not allowed in names on Windows, SMB and FAT. + is not reserved,
+// but has always been removed from names.
+const reservedChars = `<>:"/\|?*+`
+
+// Names reserved for devices on Windows, also with an extension
+var reservedNames = []string{
+	"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9",
+}
+
+// Make a name safe as a file or directory name on Windows, SMB and FAT
+// targets. The name is normalized to NFC, reserved and control characters
+// are removed, whitespace is collapsed and the name is truncated to
+// maxNameBytes on a character boundary.
+func sanitizeName(name string) string {
+	var sb strings.Builder
+	space := false
+	for _, r := range norm.NFC.String(name) {
+		switch {
+		case r == utf8.RuneError || strings.ContainsRune(reservedChars, r):
+			continue
+		case unicode.IsSpace(r) || unicode.IsControl(r):
+			space = true
+			continue
+		}
+		if space && sb.Len() > 0 {
+			sb.WriteByte(' ')
+		}
+		space = false
+		sb.WriteRune(r)
+	}
+	n := truncateBytes(sb.String(), maxNameBytes)
+
+	// Windows drops trailing dots and spaces, so names ending in them can not be opened
+	n = strings.TrimRight(n, ". ")
+	base, _, _ := strings.Cut(n, ".")
+	if slices.Contains(reservedNames, strings.ToUpper(strings.TrimSpace(base))) {
+		n = "_" + n
+	}
+	if len(n) == 0 {
+		n = "_"
+	}
+	return n
+}
+
+// Truncate a string to at most max bytes, without splitting a character
+func truncateBytes(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max]
+}
+
+// Key of a name as compared by case insensitive file systems
+func nameKey(name string) string {
+	return strings.ToLower(name)
+}
+
+// File names of the items of a playlist, without extension. Items keep the
+// file name assigned in their history. The other items are named after their
+// sanitized titles, and titles that collide, also ignoring case, with each
+// other or with an assigned name are told apart by a date suffix, and by an
+// id suffix if the date collides as well. The oldest item keeps the plain
+// title, so names stay stable as newer items are added.
+func itemFileNames(playlist []PlaylistItem) []string {
+	names := make([]string, len(playlist))
+	// Item names that would overwrite a file of the playlist directory, such as tvshow.nfo
+	taken := make(map[string]bool)
+	for _, file := range playlistFiles {
+		for _, ext := range itemExtensions {
+			if strings.HasSuffix(file, ext) {
+				taken[nameKey(strings.TrimSuffix(file, ext))] = true
+			}
+		}
+	}
+	for i, item := range playlist {
+		if len(item.fileName) > 0 {
+			names[i] = item.fileName
+			taken[nameKey(item.fileName)] = true
+		}
+	}
+
+	groups := make(map[string][]int)
+	var keys []string
+	for i, item := range playlist {
+		if len(names[i]) > 0 {
+			continue
+		}
+		names[i] = sanitizeName(item.title)
+		key := nameKey(names[i])
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+	// A suffixed name must not take the plain title of another item
+	titles := make(map[string]bool)
+	for _, key := range keys {
+		titles[key] = true
+	}
+
+	for _, key := range keys {
+		group := groups[key]
+		slices.SortStableFunc(group, func(a, b int) int {
+			return playlist[a].time.Compare(playlist[b].time)
+		})
+		for j, i := range group {
+			if j == 0 && !taken[key] {
+				taken[key] = true
+				continue
+			}
+			name := names[i] + " (" + playlist[i].time.Format(time.DateOnly) + ")"
+			if taken[nameKey(name)] || titles[nameKey(name)] {
+				name = names[i] + " [" + itemSuffix(playlist[i]) + "]"
+			}
+			names[i] = name
+			taken[nameKey(name)] = true
+		}
+	}
+	return names
+}
+
+// Suffix telling an item apart, its id or else a hash of its key
+func itemSuffix(item PlaylistItem) string {
+	if len(item.id) > 0 {
+		return sanitizeName(item.id)
+	}
+	sum := sha1.Sum([]byte(item.key()))
+	return hex.EncodeToString(sum[:4])
+}
+
+// Playlist directory names taken in a parent directory, compared as case
+// insensitive file systems compare them
+type dirNames map[string]bool
+
+// The title, or the title with the suffix if its directory name is taken, so
+// that playlists with colliding titles get directories of their own
+func (names dirNames) claim(title, suffix string) string {
+	if names[nameKey(playlistDirName(title))] {
+		suffix = " [" + sanitizeName(suffix) + "]"
+		title = truncateBytes(playlistDirName(title), maxNameBytes-len(suffix)) + suffix
+	}
+	names[nameKey(playlistDirName(title))] = true
+	return title
+}
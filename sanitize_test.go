@@ -0,0 +1,120 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Plain title", "Plain title"},
+		{`a<b>c:d"e/f\g|h?i*j+k`, "abcdefghijk"},
+		{"tabs\tand\nnewlines  collapse", "tabs and newlines collapse"},
+		{"  leading and trailing  ", "leading and trailing"},
+		{"ends with dots...", "ends with dots"},
+		{"CON", "_CON"},
+		{"con.txt", "_con.txt"},
+		{"Console", "Console"},
+		{"???", "_"},
+		{"", "_"},
+		{"é", "é"},
+	}
+	for _, test := range tests {
+		if got := sanitizeName(test.name); got != test.want {
+			t.Errorf("sanitizeName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSanitizeNameTruncates(t *testing.T) {
+	got := sanitizeName(strings.Repeat("å", maxNameBytes))
+	if len(got) > maxNameBytes || !utf8.ValidString(got) {
+		t.Errorf("sanitizeName of long name = %d bytes, valid %v", len(got), utf8.ValidString(got))
+	}
+}
+
+func TestItemFileNames(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name     string
+		playlist []PlaylistItem
+		want     []string
+	}{
+		{"unique",
+			[]PlaylistItem{{title: "A", time: day(1)}, {title: "B", time: day(2)}},
+			[]string{"A", "B"}},
+		{"oldest keeps the plain name",
+			[]PlaylistItem{{title: "News", time: day(2)}, {title: "News", time: day(1)}},
+			[]string{"News (2024-01-02)", "News"}},
+		{"collision ignoring case",
+			[]PlaylistItem{{title: "news", time: day(1)}, {title: "News", time: day(2)}},
+			[]string{"news", "News (2024-01-02)"}},
+		{"same date gets the id",
+			[]PlaylistItem{{title: "News", time: day(1), id: "a"}, {title: "News", time: day(1), id: "b"}, {title: "News", time: day(1), id: "c"}},
+			[]string{"News", "News (2024-01-01)", "News [c]"}},
+		{"reserved playlist file name",
+			[]PlaylistItem{{title: "tvshow", time: day(1)}},
+			[]string{"tvshow (2024-01-01)"}},
+		{"assigned name is kept",
+			[]PlaylistItem{{title: "News", time: day(2), fileName: "News (2024-01-02)"}},
+			[]string{"News (2024-01-02)"}},
+		{"older item does not take an assigned name",
+			[]PlaylistItem{{title: "News", time: day(2), fileName: "News"}, {title: "News", time: day(1)}},
+			[]string{"News", "News (2024-01-01)"}},
+		{"no id gets a hash of the key",
+			[]PlaylistItem{{title: "News", time: day(1), url: "a"}, {title: "News", time: day(1), url: "b"}, {title: "News", time: day(1), url: "c"}},
+			[]string{"News", "News (2024-01-01)", "News [84a51684]"}},
+	}
+	for _, test := range tests {
+		got := itemFileNames(test.playlist)
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("%s: itemFileNames = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDirNamesClaim(t *testing.T) {
+	names := make(dirNames)
+	if got := names.claim("News", "a"); got != "News" {
+		t.Errorf("first claim = %q", got)
+	}
+	if got := names.claim("news", "b"); got != "news [b]" {
+		t.Errorf("claim differing in case = %q", got)
+	}
+	if got := names.claim("Sport", "c"); got != "Sport" {
+		t.Errorf("unrelated claim = %q", got)
+	}
+	long := strings.Repeat("x", 300)
+	names.claim(long, "d")
+	if got := names.claim(long, "e"); !strings.HasSuffix(got, " [e]") || len(playlistDirName(got)) > maxNameBytes {
+		t.Errorf("claim of long name = %q", got)
+	}
+}
+
+func TestRecordHistoryKeepsFileNames(t *testing.T) {
+	stateDir = t.TempDir()
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 12, 0, 0, 0, time.UTC) }
+	older := PlaylistItem{title: "Ep 1", id: "a", source: "test", time: day(1)}
+	newer := PlaylistItem{title: "Ep 1", id: "b", source: "test", time: day(2)}
+
+	playlist, err := recordHistory("feed", []PlaylistItem{newer, older}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if playlist[0].fileName != "Ep 1 (2024-01-02)" || playlist[1].fileName != "Ep 1" {
+		t.Fatalf("file names = %q, %q", playlist[0].fileName, playlist[1].fileName)
+	}
+	// The older item dropped out of the feed, the newer keeps its name
+	playlist, err = recordHistory("feed", []PlaylistItem{newer}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := itemFileNames(playlist); got[0] != "Ep 1 (2024-01-02)" {
+		t.Errorf("file name after the older item dropped out = %q", got[0])
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A stanza entry scheduled for refresh
+type scheduledEntry struct {
+	entry    Entry
+	prefix   string
+	next     time.Time
+	failures int
+	running  bool
+}
+
+// Scheduler refreshing each stanza entry on its own interval. Entries that
+// fail are retried with exponential backoff, up to maxBackoff.
+type scheduler struct {
+	mu                    sync.Mutex
+	entries               map[string]*scheduledEntry
+	destinationDir        string
+	parseChannelPlaylists bool
+	maxBackoff            time.Duration
+	slots                 chan struct{}
+	wg                    sync.WaitGroup
+}
+
+// Keep running, reloading the stanza file when it changes and refreshing each
+// entry when its refresh interval has passed, until interrupted. The resolver,
+// if any, is served alongside.
+func serve(filename string, name string, destinationDir string, parseChannelPlaylists bool, workers int, maxBackoff time.Duration, r *resolver) error {
+	if filename == "-" {
+		return errors.New("serve needs a stanza file, standard input can not be reloaded")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if r != nil {
+		go func() {
+			err := r.serve(ctx)
+			if err != nil {
+				slog.Error("Resolver stopped", "error", err)
+			}
+		}()
+	}
+
+	s := &scheduler{
+		entries:               make(map[string]*scheduledEntry),
+		destinationDir:        destinationDir,
+		parseChannelPlaylists: parseChannelPlaylists,
+		maxBackoff:            maxBackoff,
+		slots:                 make(chan struct{}, max(workers, 1)),
+	}
+
+	var modTime time.Time
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		info, err := os.Stat(filename)
+		if err != nil {
+			slog.Error("Could not stat stanza file", "filename", filename, "error", err)
+		} else if !info.ModTime().Equal(modTime) {
+			prefix, entries, err := readEntries(filename, name)
+			err = logDiagnostics(err)
+			if err != nil {
+				slog.Error("Could not reload stanza file", "filename", filename, "error", err)
+			} else {
+				s.reload(prefix, entries)
+			}
+			modTime = info.ModTime()
+		}
+
+		s.runDue()
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Stopping, waiting for running entries to finish")
+			s.wg.Wait()
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Update the scheduled entries from the stanza file. New entries are due
+// immediately, entries already scheduled keep their schedule.
+func (s *scheduler) reload(prefix string, entries []Entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	urls := make(map[string]bool)
+	for _, entry := range entries {
+		urls[entry.url] = true
+		if scheduled, ok := s.entries[entry.url]; ok {
+			scheduled.entry = entry
+			scheduled.prefix = prefix
+		} else {
+			slog.Debug("Scheduling entry", "title", entry.title, "url", entry.url, "refresh", entry.options.refresh)
+			s.entries[entry.url] = &scheduledEntry{entry: entry, prefix: prefix, next: time.Now()}
+		}
+	}
+	for url, scheduled := range s.entries {
+		if !urls[url] {
+			slog.Debug("Unscheduling entry", "title", scheduled.entry.title, "url", url)
+			delete(s.entries, url)
+		}
+	}
+	slog.Info("Loaded stanza file", "prefix", prefix, "entries", len(s.entries))
+}
+
+func (s *scheduler) runDue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, entry := range s.entries {
+		if entry.running || entry.next.After(now) {
+			continue
+		}
+		entry.running = true
+		s.wg.Add(1)
+		go s.run(entry)
+	}
+}
+
+func (s *scheduler) run(entry *scheduledEntry) {
+	defer s.wg.Done()
+	s.slots <- struct{}{}
+	defer func() { <-s.slots }()
+
+	s.mu.Lock()
+	e, prefix := entry.entry, entry.prefix
+	title, url := e.title, e.url
+	s.mu.Unlock()
+
+	err := parsePlaylist(e, s.destinationDir, prefix, s.parseChannelPlaylists)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry.running = false
+	delay := max(e.options.refresh, time.Minute)
+	if err != nil {
+		entry.failures++
+		delay = s.backoff(delay, entry.failures)
+		slog.Warn("Entry failed, backing off", "title", title, "url", url, "failures", entry.failures, "retryIn", delay, "error", err)
+	} else {
+		entry.failures = 0
+	}
+	entry.next = time.Now().Add(delay)
+	slog.Debug("Scheduled next refresh", "title", title, "url", url, "next", entry.next)
+}
+
+// The refresh interval doubled for each consecutive failure, up to maxBackoff
+func (s *scheduler) backoff(refresh time.Duration, failures int) time.Duration {
+	delay := refresh
+	for i := 0; i < failures && delay < s.maxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, max(s.maxBackoff, refresh))
+}
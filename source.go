@@ -0,0 +1,93 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+)
+
+// Source is a provider of playlists, such as YouTube or SVT Play. A source
+// recognizes the stanza urls it handles, resolves them into feeds, maps feed
+// items to streams and may recurse into further playlists found in items.
+type Source interface {
+	// Name returns a short identifier for the source
+	Name() string
+
+	// Match reports whether the stanza url is handled by this source
+	Match(url string) bool
+
+	// Parse resolves the stanza url into one or more feeds and writes their playlists
+	Parse(title, url, destinationDir, prefix string, parseChannelPlaylists bool, options Options) error
+
+	// Stream maps a feed item to a stream, ok is false if the item is not handled by this source
+	Stream(item *gofeed.Item) (stream Stream, ok bool)
+
+	// Recurse returns the feed url of a playlist that the item refers to, if any
+	Recurse(item PlaylistItem) (feedUrl string, ok bool)
+}
+
+// ArtworkSource is a source that can find folder artwork for its feeds
+type ArtworkSource interface {
+	// Artwork returns the artwork urls of the feed, ok is false if the feed is not from this source
+	Artwork(feedUrl string, info PlaylistInfo) (artwork FolderArtwork, ok bool)
+}
+
+// ContentStreamSource is a source that can find streams linked in the content
+// of feed items, such as a YouTube link in a Reddit post. Links in content are
+// only used for items that no source maps to a stream by themselves, so that
+// a podcast episode mentioning a video is still the episode.
+type ContentStreamSource interface {
+	// ContentStream maps a feed item to a stream linked in its content, ok is false if there is none
+	ContentStream(item *gofeed.Item) (stream Stream, ok bool)
+}
+
+// Urls of the artwork of a playlist directory, empty if there is none
+type FolderArtwork struct {
+	poster string
+	fanart string
+	banner string
+}
+
+// Stream is what a source maps a feed item to
+type Stream struct {
+	id      string
+	url     string
+	strmUrl string
+	// Mime type of the media at url, if known
+	mimeType string
+}
+
+// Registered sources. Sources are tried in order, both when matching stanza
+// urls and when mapping feed items to streams. Stanza urls not matched by any
+// source are treated as plain feed urls.
+var sources = []Source{
+	svtSource{},
+	youtubeSource{},
+	redditSource{},
+	enclosureSource{},
+}
+
+func sourceByName(name string) Source {
+	for _, source := range sources {
+		if source.Name() == name {
+			return source
+		}
+	}
+	return nil
+}
+
+// Find the first source that maps the feed item to a stream, or else the
+// first source that finds a stream linked in its content
+func streamForItem(item *gofeed.Item) (Source, Stream, bool) {
+	for _, source := range sources {
+		if stream, ok := source.Stream(item); ok {
+			return source, stream, true
+		}
+	}
+	for _, source := range sources {
+		if contentSource, ok := source.(ContentStreamSource); ok {
+			if stream, ok := contentSource.ContentStream(item); ok {
+				return source, stream, true
+			}
+		}
+	}
+	return nil, Stream{}, false
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The staged output renders each playlist directory into a staging directory
+// next to it, and swaps it into place with renames once the playlist is
+// complete. The staging directory starts out as a copy of the playlist
+// directory, with files hard linked rather than copied, and files are always
+// replaced rather than written in place, so the playlist directory is never
+// seen half written.
+//
+// On Linux the swap exchanges the two directories in one step. Elsewhere it
+// renames the playlist directory to a backup, then the staging directory to
+// the playlist directory, and a run interrupted between the two is recovered
+// from the backup when the playlist is next written, so that the playlist is
+// either the old or the new version, never a mix.
+type stagedOutput struct {
+	diskOutput
+	mu sync.Mutex
+	// Staging directory by playlist directory
+	staging map[string]string
+}
+
+func newStagedOutput(log *changeLog) *stagedOutput {
+	return &stagedOutput{diskOutput: diskOutput{log: log}, staging: make(map[string]string)}
+}
+
+func stagingDir(dir string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".plg-staging")
+}
+
+func backupDir(dir string) string {
+	return filepath.Join(filepath.Dir(dir), "."+filepath.Base(dir)+".plg-old")
+}
+
+// The path in the staging directory of a path in a staged playlist directory
+func (s *stagedOutput) path(path string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path = filepath.Clean(path)
+	for dir := path; ; dir = filepath.Dir(dir) {
+		if staging, ok := s.staging[dir]; ok {
+			return staging + strings.TrimPrefix(path, dir)
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return path
+		}
+	}
+}
+
+func (s *stagedOutput) MkdirAll(dir string) error {
+	return s.diskOutput.MkdirAll(s.path(dir))
+}
+
+func (s *stagedOutput) WriteFile(file string, data []byte, t time.Time) error {
+	err := s.diskOutput.writeFile(s.path(file), file, data)
+	if err != nil {
+		return err
+	}
+	return s.Chtimes(file, t)
+}
+
+// Removing a staged playlist directory itself is left to the commit, which
+// removes the playlist if the staging directory ends up empty
+func (s *stagedOutput) Remove(path string) error {
+	s.mu.Lock()
+	_, staged := s.staging[filepath.Clean(path)]
+	s.mu.Unlock()
+	if staged {
+		return nil
+	}
+	return s.diskOutput.remove(s.path(path), path)
+}
+
+// A staged file that is not written may still be linked to the file in the
+// playlist directory, so it is replaced by a copy before its mtime is
+// changed, leaving the playlist directory as it is until the commit
+func (s *stagedOutput) Chtimes(path string, t time.Time) error {
+	staged := s.path(path)
+	info, err := os.Stat(staged)
+	if err == nil && info.Mode().IsRegular() && !info.ModTime().Truncate(time.Second).Equal(t.Truncate(time.Second)) {
+		data, err := os.ReadFile(staged)
+		if err != nil {
+			return err
+		}
+		err = replaceFile(staged, data)
+		if err != nil {
+			return err
+		}
+	}
+	return s.diskOutput.Chtimes(staged, t)
+}
+
+func (s *stagedOutput) ReadDir(dir string) ([]OutputEntry, error) {
+	return s.diskOutput.ReadDir(s.path(dir))
+}
+
+func (s *stagedOutput) ModTime(path string) (time.Time, error) {
+	return s.diskOutput.ModTime(s.path(path))
+}
+
+// A playlist directory being staged, nil if the output is not staged
+type stagedDir struct {
+	output *stagedOutput
+	dir    string
+	done   bool
+}
+
+// Start staging the playlist directory, if the output is staged. Output to
+// the directory goes to the staging directory until committed.
+func beginStaging(dir string) (*stagedDir, error) {
+	s, ok := output.(*stagedOutput)
+	if !ok {
+		return nil, nil
+	}
+	dir = filepath.Clean(dir)
+	err := recoverStaging(dir)
+	if err != nil {
+		return nil, err
+	}
+	staging := stagingDir(dir)
+	err = linkTree(dir, staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return nil, err
+	}
+	s.mu.Lock()
+	s.staging[dir] = staging
+	s.mu.Unlock()
+	slog.Debug("Staging playlist", "directory", dir, "staging", staging)
+	return &stagedDir{output: s, dir: dir}, nil
+}
+
+// Recover the playlist directory from an interrupted run, if the output is staged
+func recoverStaged(dir string) error {
+	if _, ok := output.(*stagedOutput); !ok {
+		return nil
+	}
+	return recoverStaging(filepath.Clean(dir))
+}
+
+// Clean up after an interrupted run. A left over staging directory is
+// incomplete and removed. A left over backup is the old version, it is
+// restored if the swap did not complete and removed otherwise.
+func recoverStaging(dir string) error {
+	err := os.RemoveAll(stagingDir(dir))
+	if err != nil {
+		return err
+	}
+	backup := backupDir(dir)
+	if _, err := os.Stat(backup); err != nil {
+		return nil
+	}
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Restoring playlist from interrupted swap", "directory", dir)
+		return os.Rename(backup, dir)
+	}
+	return os.RemoveAll(backup)
+}
+
+// Copy the directory tree, hard linking the files, or copying them where the
+// file system does not support links. A missing directory is copied as empty.
+func linkTree(src, dst string) error {
+	var dirs []string
+	var modTimes []time.Time
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == src && errors.Is(err, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() && isStagingName(d.Name()) {
+			return filepath.SkipDir
+		}
+		target := dst + strings.TrimPrefix(path, src)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			dirs = append(dirs, target)
+			modTimes = append(modTimes, info.ModTime())
+			return os.Mkdir(target, os.ModePerm)
+		}
+		err = os.Link(path, target)
+		if err == nil {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		err = os.WriteFile(target, data, info.Mode().Perm())
+		if err != nil {
+			return err
+		}
+		return os.Chtimes(target, info.ModTime(), info.ModTime())
+	})
+	if err != nil {
+		return err
+	}
+	// Creating the contents changed the mtimes of the directories
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = os.Chtimes(dirs[i], modTimes[i], modTimes[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Swap the staging directory into place. The mtime of the parent directory
+// is kept, as the swap is not a change to its contents. A playlist left
+// without files is removed rather than swapped.
+func (d *stagedDir) commit() error {
+	if d == nil || d.done {
+		return nil
+	}
+	d.done = true
+	d.output.mu.Lock()
+	staging := d.output.staging[d.dir]
+	delete(d.output.staging, d.dir)
+	d.output.mu.Unlock()
+
+	parent := filepath.Dir(d.dir)
+	parentInfo, parentErr := os.Stat(parent)
+	defer func() {
+		if parentErr == nil {
+			os.Chtimes(parent, parentInfo.ModTime(), parentInfo.ModTime())
+		}
+	}()
+
+	entries, err := os.ReadDir(staging)
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	if len(entries) == 0 {
+		os.Remove(staging)
+		return removeStaged(d.dir)
+	}
+
+	err = swapDirs(staging, d.dir)
+	if err != nil {
+		os.RemoveAll(staging)
+		return err
+	}
+	slog.Debug("Swapped staged playlist into place", "directory", d.dir)
+	return nil
+}
+
+// Remove a playlist directory, renaming it out of the way first so that it
+// disappears at once
+func removeStaged(dir string) error {
+	backup := backupDir(dir)
+	err := os.Rename(dir, backup)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(backup)
+}
+
+// Move the staging directory to the playlist directory, replacing it. Where
+// the system can exchange the two in one step the playlist directory always
+// exists. Elsewhere it is renamed to a backup first, so that for a moment it
+// does not exist, and an interruption in that moment is recovered by
+// recoverStaging.
+func swapDirs(staging, dir string) error {
+	if _, err := os.Stat(dir); errors.Is(err, fs.ErrNotExist) {
+		return os.Rename(staging, dir)
+	}
+	if exchangeDirs(staging, dir) == nil {
+		// The staging path now holds the old playlist
+		err := os.RemoveAll(staging)
+		if err != nil {
+			slog.Error("Could not remove old playlist", "directory", staging, "error", err)
+		}
+		return nil
+	}
+
+	backup := backupDir(dir)
+	err := os.Rename(dir, backup)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(staging, dir)
+	if err != nil {
+		os.Rename(backup, dir)
+		return err
+	}
+	err = os.RemoveAll(backup)
+	if err != nil {
+		slog.Error("Could not remove old playlist", "directory", backup, "error", err)
+	}
+	return nil
+}
+
+// Discard the staging directory, unless committed, leaving the playlist directory as it was
+func (d *stagedDir) abort() {
+	if d == nil || d.done {
+		return
+	}
+	d.done = true
+	d.output.mu.Lock()
+	staging := d.output.staging[d.dir]
+	delete(d.output.staging, d.dir)
+	d.output.mu.Unlock()
+	err := os.RemoveAll(staging)
+	if err != nil {
+		slog.Error("Could not remove staging directory", "directory", staging, "error", err)
+	}
+}
+
+// Whether the name is a staging or backup directory of a playlist
+func isStagingName(name string) bool {
+	return strings.HasPrefix(name, ".") && slices.ContainsFunc([]string{".plg-staging", ".plg-old"}, func(suffix string) bool {
+		return strings.HasSuffix(name, suffix)
+	})
+}
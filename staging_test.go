@@ -0,0 +1,143 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStagedCommit(t *testing.T) {
+	saved := output
+	defer func() { output = saved }()
+	output = newStagedOutput(nil)
+
+	dir := filepath.Join(t.TempDir(), "Playlist")
+	write := func(files ...string) {
+		staged, err := beginStaging(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer staged.abort()
+		err = output.MkdirAll(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			err = output.WriteFile(filepath.Join(dir, file), []byte(file), time.Unix(1, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(dir, files[0])); err == nil {
+			t.Errorf("%s visible before commit", files[0])
+		}
+		err = staged.commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a.strm")
+	write("b.strm")
+	for _, file := range []string{"a.strm", "b.strm"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Errorf("%s missing after commit: %v", file, err)
+		}
+	}
+	entries, _ := os.ReadDir(filepath.Dir(dir))
+	if len(entries) != 1 {
+		t.Errorf("staging or backup left behind: %v", entries)
+	}
+
+	// A playlist left without files is removed at commit
+	staged, err := beginStaging(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"a.strm", "b.strm"} {
+		output.Remove(filepath.Join(dir, file))
+	}
+	err = output.Remove(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Error("playlist removed before commit")
+	}
+	err = staged.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("empty playlist not removed: %v", err)
+	}
+}
+
+func TestRecoverStaging(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Playlist")
+	os.MkdirAll(backupDir(dir), os.ModePerm)
+	os.WriteFile(filepath.Join(backupDir(dir), "a.strm"), nil, 0644)
+	os.MkdirAll(stagingDir(dir), os.ModePerm)
+
+	err := recoverStaging(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.strm")); err != nil {
+		t.Errorf("backup not restored: %v", err)
+	}
+	if _, err := os.Stat(stagingDir(dir)); !os.IsNotExist(err) {
+		t.Errorf("staging not removed: %v", err)
+	}
+}
+
+func TestStagedChtimesLeavesPlaylist(t *testing.T) {
+	saved := output
+	defer func() { output = saved }()
+	output = newStagedOutput(nil)
+
+	dir := filepath.Join(t.TempDir(), "Playlist")
+	file := filepath.Join(dir, "a.strm")
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(file, []byte("a"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chtimes(file, time.Unix(1, 0), time.Unix(1, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged, err := beginStaging(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staged.abort()
+	// Unchanged content with a new mtime
+	err = output.WriteFile(file, []byte("a"), time.Unix(2, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(time.Unix(1, 0)) {
+		t.Errorf("mtime changed before commit: %v", info.ModTime())
+	}
+	err = staged.commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(time.Unix(2, 0)) {
+		t.Errorf("mtime after commit = %v", info.ModTime())
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+)
+
+// A problem with an entry of a stanza or config file
+type Diagnostic struct {
+	file    string
+	line    int
+	message string
+}
+
+func (d Diagnostic) Error() string {
+	return fmt.Sprintf("%s:%d: %s", d.file, d.line, d.message)
+}
+
+// The problems found reading a stanza or config file. The entries read
+// alongside them are the valid ones, and can still be used.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	messages := make([]string, len(d))
+	for i, diagnostic := range d {
+		messages[i] = diagnostic.Error()
+	}
+	return strings.Join(messages, "\n")
+}
+
+// The diagnostics in line order
+func (d Diagnostics) sorted() Diagnostics {
+	slices.SortStableFunc(d, func(a, b Diagnostic) int {
+		return a.line - b.line
+	})
+	return d
+}
+
+// Log the diagnostics in err, if any. Other errors are returned.
+func logDiagnostics(err error) error {
+	diagnostics, ok := err.(Diagnostics)
+	if !ok {
+		return err
+	}
+	for _, diagnostic := range diagnostics {
+		slog.Error("Invalid entry, skipping", "file", diagnostic.file, "line", diagnostic.line, "error", diagnostic.message)
+	}
+	return nil
+}
+
+// Check a stanza or config file, printing its problems. Returns the exit code.
+func validate(filename string, name string) int {
+	prefix, entries, err := readEntries(filename, name)
+	if diagnostics, ok := err.(Diagnostics); ok {
+		for _, diagnostic := range diagnostics {
+			fmt.Fprintln(os.Stderr, diagnostic)
+		}
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Printf("%s: %d entries, prefix %s\n", filename, len(entries), prefix)
+	return 0
+}
+
+func isUrl(line string) bool {
+	return strings.HasPrefix(line, "http://") || strings.HasPrefix(line, "https://")
+}
+
+// Parse the lines of a stanza file into entries, in file order. Each entry is
+// a title line followed by a url line. Lines starting with # are comments and
+// blank lines separate entries.
+func parseStanzaLines(file string, lines []string) ([]Entry, Diagnostics) {
+	var entries []Entry
+	var diagnostics Diagnostics
+	report := func(line int, format string, args ...any) {
+		diagnostics = append(diagnostics, Diagnostic{file: file, line: line, message: fmt.Sprintf(format, args...)})
+	}
+
+	title := ""
+	titleLine := 0
+	for i, line := range lines {
+		lineNumber := i + 1
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#"):
+			continue
+		case len(line) == 0:
+			if titleLine > 0 {
+				report(titleLine, "title %q is not followed by a url", title)
+				titleLine = 0
+			}
+		case isUrl(line):
+			if titleLine == 0 {
+				report(lineNumber, "url %s is not preceded by a title", line)
+				continue
+			}
+			options, err := defaultOptions.forUrl(line)
+			if err != nil {
+				report(lineNumber, "%v", err)
+				titleLine = 0
+				continue
+			}
+			entries = append(entries, Entry{title: title, url: line, file: file, line: titleLine, options: options})
+			titleLine = 0
+		default:
+			if titleLine > 0 {
+				report(titleLine, "title %q is not followed by a url", title)
+			}
+			title = line
+			titleLine = lineNumber
+		}
+	}
+	if titleLine > 0 {
+		report(titleLine, "title %q is not followed by a url", title)
+	}
+
+	entries, duplicates := removeDuplicates(entries)
+	return entries, append(diagnostics, duplicates...).sorted()
+}
+
+// Remove entries with the url, or the title, of an earlier entry. Entries
+// whose titles differ but map to the same playlist directory, such as titles
+// differing only in case, get a suffix from their url.
+func removeDuplicates(entries []Entry) ([]Entry, Diagnostics) {
+	var diagnostics Diagnostics
+	urls := make(map[string]Entry)
+	titles := make(map[string]Entry)
+	names := make(map[string]dirNames)
+	unique := make([]Entry, 0, len(entries))
+	for _, entry := range entries {
+		url := stripFragment(entry.url)
+		title := entry.destinationDir + "/" + strings.Trim(entry.title, " .")
+		if first, ok := urls[url]; ok {
+			diagnostics = append(diagnostics, Diagnostic{file: entry.file, line: entry.line,
+				message: fmt.Sprintf("duplicate url %s, first listed at line %d", url, first.line)})
+			continue
+		}
+		if first, ok := titles[title]; ok {
+			diagnostics = append(diagnostics, Diagnostic{file: entry.file, line: entry.line,
+				message: fmt.Sprintf("duplicate title %q, first listed at line %d", entry.title, first.line)})
+			continue
+		}
+		urls[url] = entry
+		titles[title] = entry
+
+		if names[entry.destinationDir] == nil {
+			names[entry.destinationDir] = make(dirNames)
+		}
+		sum := sha1.Sum([]byte(url))
+		claimed := names[entry.destinationDir].claim(strings.Trim(entry.title, " ."), hex.EncodeToString(sum[:4]))
+		if claimed != strings.Trim(entry.title, " .") {
+			slog.Warn("Title collides with the directory of an earlier entry, adding a suffix", "file", entry.file, "line", entry.line, "title", entry.title, "directory", playlistDirName(claimed))
+			entry.title = claimed
+		}
+		unique = append(unique, entry)
+	}
+	return unique, diagnostics
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStanzaLines(t *testing.T) {
+	tests := []struct {
+		name        string
+		lines       string
+		titles      []string
+		diagnostics []string
+	}{
+		{"entries and comments",
+			"# comment\nOne\nhttps://example.com/one.xml\n\nTwo\nhttps://example.com/two.xml\n",
+			[]string{"One", "Two"}, nil},
+		{"title without url",
+			"One\n\nTwo\nhttps://example.com/two.xml\nThree",
+			[]string{"Two"},
+			[]string{`s.txt:1: title "One" is not followed by a url`, `s.txt:5: title "Three" is not followed by a url`}},
+		{"url without title",
+			"https://example.com/one.xml\n",
+			nil,
+			[]string{"s.txt:1: url https://example.com/one.xml is not preceded by a title"}},
+		{"title replaced by the next title",
+			"One\nTwo\nhttps://example.com/two.xml\n",
+			[]string{"Two"},
+			[]string{`s.txt:1: title "One" is not followed by a url`}},
+		{"duplicate url ignoring fragment",
+			"One\nhttps://example.com/one.xml\n\nTwo\nhttps://example.com/one.xml#maxitems=5\n",
+			[]string{"One"},
+			[]string{"s.txt:4: duplicate url https://example.com/one.xml, first listed at line 1"}},
+		{"duplicate title",
+			"One\nhttps://example.com/one.xml\n\nOne\nhttps://example.com/two.xml\n",
+			[]string{"One"},
+			[]string{`s.txt:4: duplicate title "One", first listed at line 1`}},
+		{"title differing in case gets a suffix",
+			"News\nhttps://example.com/one.xml\n\nnews\nhttps://example.com/two.xml\n",
+			[]string{"News", "news [7d889d81]"}, nil},
+		{"invalid fragment option",
+			"One\nhttps://example.com/one.xml#maxage=abc\n",
+			nil,
+			[]string{`s.txt:2: invalid option maxage in url: time: invalid duration "abc"`}},
+	}
+	for _, test := range tests {
+		entries, diagnostics := parseStanzaLines("s.txt", strings.Split(test.lines, "\n"))
+		var titles []string
+		for _, entry := range entries {
+			titles = append(titles, entry.title)
+		}
+		if strings.Join(titles, "|") != strings.Join(test.titles, "|") {
+			t.Errorf("%s: titles = %q, want %q", test.name, titles, test.titles)
+		}
+		var messages []string
+		for _, diagnostic := range diagnostics {
+			messages = append(messages, diagnostic.Error())
+		}
+		if strings.Join(messages, "\n") != strings.Join(test.diagnostics, "\n") {
+			t.Errorf("%s: diagnostics = %q, want %q", test.name, messages, test.diagnostics)
+		}
+	}
+}
+
+func TestParseStanzaLinesOptions(t *testing.T) {
+	entries, diagnostics := parseStanzaLines("s.txt", []string{"One", "https://example.com/one.xml#p&maxitems=5&exclude=%23shorts"})
+	if len(diagnostics) > 0 || len(entries) != 1 {
+		t.Fatalf("entries = %v, diagnostics = %v", entries, diagnostics)
+	}
+	options := entries[0].options
+	if options.maxItems != 5 || options.sections != "p" || options.filter.exclude == nil || options.filter.exclude.String() != "#shorts" {
+		t.Errorf("options = %+v", options)
+	}
+}
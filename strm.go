@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Strm profiles decide what is written to the .strm file of an item, which
+// depends on the player. Profiles map sources to templates, sources without a
+// template in the profile use the Kodi add-on url of the source. A profile
+// can also be a raw template, given as template:<text/template>.
+const (
+	strmKodi      = "kodi"
+	strmInvidious = "invidious"
+	strmTubed     = "tubed"
+	strmDirect    = "direct"
+	strmResolver  = "resolver"
+
+	strmTemplatePrefix = "template:"
+)
+
+var strmProfiles = map[string]map[string]string{
+	strmKodi: {},
+	strmInvidious: {
+		"youtube": "plugin://plugin.video.invidious/?action=play_video&video_id={{.Id}}",
+	},
+	strmTubed: {
+		"youtube": "plugin://plugin.video.tubed/?mode=play&video_id={{.Id}}",
+	},
+	// The page or media url, for players such as mpv that resolve it themselves
+	strmDirect: {
+		"youtube":   "{{.Url}}",
+		"svt":       "{{.Url}}",
+		"enclosure": "{{.Url}}",
+	},
+	// The resolver endpoint of plg, see resolver.go
+	strmResolver: {
+		"youtube": "{{.ResolverUrl}}/play/youtube/{{.Id}}",
+	},
+}
+
+// The fields of a playlist item, as available to templates
+type ItemData struct {
+	Title        string
+	SortTitle    string
+	Description  string
+	Author       string
+	Url          string
+	IconUrl      string
+	StrmUrl      string
+	Id           string
+	RecursiveUrl string
+	Time         time.Time
+	Duration     time.Duration
+	MimeType     string
+	Source       string
+	Playlist     string
+	ResolverUrl  string
+}
+
+func newItemData(item PlaylistItem, playlist string) ItemData {
+	return ItemData{
+		Title:        item.title,
+		SortTitle:    item.sorttitle,
+		Description:  item.description,
+		Author:       item.author,
+		Url:          item.url,
+		IconUrl:      item.iconUrl,
+		StrmUrl:      item.strmUrl,
+		Id:           item.id,
+		RecursiveUrl: item.recursiveUrl,
+		Time:         item.time,
+		Duration:     item.duration,
+		MimeType:     item.mimeType,
+		Source:       item.source,
+		Playlist:     playlist,
+		ResolverUrl:  resolverUrl,
+	}
+}
+
+// Parse strm profiles separated by ;, each for all sources or, prefixed by
+// source=, for one source. For example tubed;svt=direct
+func parseStrmProfiles(value string, profiles map[string]string) (map[string]string, error) {
+	profiles = maps.Clone(profiles)
+	if profiles == nil {
+		profiles = make(map[string]string)
+	}
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		source := ""
+		if name, profile, found := strings.Cut(part, "="); found && sourceByName(name) != nil {
+			source, part = name, profile
+		}
+		err := validateStrmProfile(part)
+		if err != nil {
+			return nil, err
+		}
+		profiles[source] = part
+	}
+	return profiles, nil
+}
+
+func validateStrmProfile(profile string) error {
+	if text, ok := strings.CutPrefix(profile, strmTemplatePrefix); ok {
+		_, err := template.New("strm").Funcs(templateFuncs).Parse(text)
+		return err
+	}
+	if _, ok := strmProfiles[profile]; !ok {
+		return fmt.Errorf("unknown strm profile %s, expected %s, %s, %s, %s, %s or %s<template>", profile, strmKodi, strmInvidious, strmTubed, strmDirect, strmResolver, strmTemplatePrefix)
+	}
+	return nil
+}
+
+// The contents of the .strm file of an item in the playlist with the given name
+func strmTarget(item PlaylistItem, name string, options Options) (string, error) {
+	profile, ok := options.strm[item.source]
+	if !ok {
+		profile = options.strm[""]
+	}
+	if profile == strmResolver && len(resolverUrl) == 0 {
+		return "", fmt.Errorf("the %s strm profile needs -resolverUrl or -resolverListen", strmResolver)
+	}
+	text, ok := strings.CutPrefix(profile, strmTemplatePrefix)
+	if !ok {
+		text, ok = strmProfiles[profile][item.source]
+		if !ok {
+			return item.strmUrl, nil
+		}
+	}
+	return executeTemplate(text, newItemData(item, name))
+}
+
+// Functions available to templates. quote shell quotes a value, for
+// templates of command lines, such as the DMS resources.
+var templateFuncs = template.FuncMap{
+	"quote": shellQuote,
+}
+
+// Quote a value as a single word for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func executeTemplate(text string, data any) (string, error) {
+	t, err := template.New("").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	err = t.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
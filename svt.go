@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	url2 "net/url"
+	"regexp"
+
+	"github.com/mmcdole/gofeed"
+)
+
+var (
+	svtRegex        = regexp.MustCompile(`www.svtplay.se\/(.*)\/rss\.xml`)
+	svtItemRegex    = regexp.MustCompile(`www.svtplay.se(\/.*)`)
+	svtProgramRegex = regexp.MustCompile(`www.svtplay.se\/([^\/]+)$`)
+)
+
+type svtSource struct{}
+
+func (svtSource) Name() string {
+	return "svt"
+}
+
+func (svtSource) Match(url string) bool {
+	return svtRegex.MatchString(url)
+}
+
+func (svtSource) Parse(title, url, destinationDir, prefix string, parseChannelPlaylists bool, options Options) error {
+	svtCategory := svtRegex.FindStringSubmatch(url)[1]
+	slog.Debug("SVT category detected", "category", svtCategory)
+	return parseAndWritePlaylists(title, fmt.Sprintf("https://www.svtplay.se/%s/rss.xml", svtCategory), destinationDir, prefix, options)
+}
+
+func (svtSource) Stream(item *gofeed.Item) (Stream, bool) {
+	matches := svtItemRegex.FindStringSubmatch(item.Link)
+	if len(matches) > 0 {
+		return Stream{url: item.Link, strmUrl: "plugin://plugin.video.svtplay/?mode=video&id=" + url2.QueryEscape(matches[1])}, true
+	}
+	return Stream{}, false
+}
+
+// The program image of the feed
+func (svtSource) Artwork(feedUrl string, info PlaylistInfo) (FolderArtwork, bool) {
+	if !svtRegex.MatchString(feedUrl) {
+		return FolderArtwork{}, false
+	}
+	return FolderArtwork{poster: info.imageUrl, fanart: info.imageUrl}, true
+}
+
+// Items linking to a program page, rather than to an episode, are recursed into
+func (svtSource) Recurse(item PlaylistItem) (string, bool) {
+	matches := svtProgramRegex.FindStringSubmatch(item.recursiveUrl)
+	if len(matches) > 0 {
+		return fmt.Sprintf("https://www.svtplay.se/%s/rss.xml", matches[1]), true
+	}
+	return "", false
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log/slog"
+	"net/http"
+	url2 "net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/mmcdole/gofeed"
+)
+
+var (
+	youtubeChannelRegex  = regexp.MustCompile(`youtube.com\/channel\/([^/?#]+)`)
+	youtubeUserRegex     = regexp.MustCompile(`youtube.com\/user\/([^/?#]+)`)
+	youtubePlaylistRegex = regexp.MustCompile(`youtube.com\/playlist\?list=([^&#]+)`)
+	youtubeCRegex        = regexp.MustCompile(`youtube.com\/c\/([^/?#]+)`)
+	youtubeHandleRegex   = regexp.MustCompile(`youtube.com\/(@[^/?#]+)`)
+
+	// Ways in which a channel page refers to its own channel id, in order of preference
+	youtubeChannelIdRegexes = []*regexp.Regexp{
+		regexp.MustCompile(`itemprop="channelId" content="(UC[a-zA-Z0-9_-]{22})"`),
+		regexp.MustCompile(`<link rel="canonical" href="https:\/\/www.youtube.com\/channel\/(UC[a-zA-Z0-9_-]{22})"`),
+		regexp.MustCompile(`"externalId":"(UC[a-zA-Z0-9_-]{22})"`),
+		regexp.MustCompile(`"browseId":"(UC[a-zA-Z0-9_-]{22})"`),
+	}
+
+	youtubeChannelFeedRegex = regexp.MustCompile(`videos.xml\?channel_id=(UC[a-zA-Z0-9_-]{22})`)
+	youtubeAvatarRegex      = regexp.MustCompile(`"avatar":\{"thumbnails":\[([^\]]*)\]`)
+	youtubeBannerRegex      = regexp.MustCompile(`"banner":\{"(?:thumbnails|imageBannerViewModel":\{"image":\{"sources)":\[([^\]]*)\]`)
+	youtubeTvBannerRegex    = regexp.MustCompile(`"tvBanner":\{"thumbnails":\[([^\]]*)\]`)
+	youtubeImageUrlRegex    = regexp.MustCompile(`"url":"([^"]+)"`)
+
+	// Links to YouTube in html or text content, up to the end of the attribute or word
+	youtubeVideoLinkRegex = regexp.MustCompile(`(?i)(?:https?:)?//(?:[a-z0-9-]+\.)*(?:youtube\.com|youtube-nocookie\.com|youtu\.be)/[^\s"'<>]+`)
+	youtubeVideoIdRegex   = regexp.MustCompile(`^[a-zA-Z0-9_-]{11}$`)
+	youtubeStartRegex     = regexp.MustCompile(`^(?:(\d+)h)?(?:(\d+)m)?(?:(\d+)s?)?$`)
+)
+
+type youtubeSource struct{}
+
+func (youtubeSource) Name() string {
+	return "youtube"
+}
+
+func (youtubeSource) Match(url string) bool {
+	return youtubeChannelRegex.MatchString(url) ||
+		youtubeCRegex.MatchString(url) ||
+		youtubeHandleRegex.MatchString(url) ||
+		youtubeUserRegex.MatchString(url) ||
+		youtubePlaylistRegex.MatchString(url)
+}
+
+func (youtubeSource) Parse(title, url, destinationDir, prefix string, parseChannelPlaylists bool, options Options) error {
+	if matches := youtubeChannelRegex.FindStringSubmatch(url); len(matches) > 0 {
+		channelID := matches[1]
+		slog.Debug("YouTube channel detected", "channel", channelID)
+		return parseAndWriteChannelPlaylists(url, channelID, parseChannelPlaylists, title, destinationDir, prefix, options)
+	} else if matches := youtubeHandleRegex.FindStringSubmatch(url); len(matches) > 0 {
+		handle := matches[1]
+		slog.Debug("YouTube handle detected", "handle", handle)
+		channelID, err := resolveYoutubeChannelID("https://www.youtube.com/" + handle)
+		if err != nil {
+			slog.Error("Could not resolve channel id for handle", "handle", handle, "error", err)
+			return err
+		}
+		return parseAndWriteChannelPlaylists(url, channelID, parseChannelPlaylists, title, destinationDir, prefix, options)
+	} else if matches := youtubeCRegex.FindStringSubmatch(url); len(matches) > 0 {
+		name := matches[1]
+		slog.Debug("YouTube c channel detected", "name", name)
+		channelID, err := resolveYoutubeChannelID("https://www.youtube.com/c/" + name)
+		if err != nil {
+			slog.Error("Could not resolve channel id for c channel", "name", name, "error", err)
+			return err
+		}
+		return parseAndWriteChannelPlaylists(url, channelID, parseChannelPlaylists, title, destinationDir, prefix, options)
+	} else if matches := youtubeUserRegex.FindStringSubmatch(url); len(matches) > 0 {
+		user := matches[1]
+		slog.Debug("YouTube user detected", "user", user)
+		channelID, err := resolveYoutubeChannelID("https://www.youtube.com/user/" + user)
+		if err != nil {
+			// The user feed still works for legacy usernames, but without channel playlists
+			slog.Warn("Could not resolve channel id for user, using user feed", "user", user, "error", err)
+			return parseAndWritePlaylists(title, fmt.Sprintf("https://www.youtube.com/feeds/videos.xml?user=%s", user), destinationDir, prefix, options)
+		}
+		return parseAndWriteChannelPlaylists(url, channelID, parseChannelPlaylists, title, destinationDir, prefix, options)
+	} else if matches := youtubePlaylistRegex.FindStringSubmatch(url); len(matches) > 0 {
+		playlist := matches[1]
+		slog.Debug("YouTube playlist detected", "playlist", playlist)
+		return parseAndWritePlaylists(title, fmt.Sprintf("https://www.youtube.com/feeds/videos.xml?playlist_id=%s", playlist), destinationDir, prefix, options)
+	}
+	return nil
+}
+
+func (youtubeSource) Stream(item *gofeed.Item) (Stream, bool) {
+	if id, start, ok := parseYoutubeVideoUrl(item.Link); ok {
+		return youtubeStream(id, youtubeVideoUrl(id, start)), true
+	}
+	return Stream{}, false
+}
+
+// For example from Reddit feed, the video is not item.Link but linked in item.Content
+func (youtubeSource) ContentStream(item *gofeed.Item) (Stream, bool) {
+	for _, link := range youtubeVideoLinkRegex.FindAllString(item.Content, -1) {
+		// Punctuation after a link in text is not part of it
+		link = strings.TrimRight(html.UnescapeString(link), ".,;:!?)]")
+		if id, start, ok := parseYoutubeVideoUrl(link); ok {
+			return youtubeStream(id, youtubeVideoUrl(id, start)), true
+		}
+	}
+	return Stream{}, false
+}
+
+// The video id and start offset in seconds of a link to a YouTube video, such
+// as a watch, shorts, live or embed link on www, m, music or nocookie, or a
+// youtu.be link
+func parseYoutubeVideoUrl(link string) (string, int, bool) {
+	if strings.HasPrefix(link, "//") {
+		link = "https:" + link
+	}
+	u, err := url2.Parse(link)
+	if err != nil {
+		return "", 0, false
+	}
+	host := strings.ToLower(u.Hostname())
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	query := u.Query()
+	id := ""
+	switch {
+	case host == "youtu.be" || host == "www.youtu.be":
+		id = segments[0]
+	case host == "youtube.com" || strings.HasSuffix(host, ".youtube.com") ||
+		host == "youtube-nocookie.com" || strings.HasSuffix(host, ".youtube-nocookie.com"):
+		switch {
+		case segments[0] == "watch":
+			id = query.Get("v")
+		case len(segments) > 1 && slices.Contains([]string{"shorts", "live", "embed", "v", "e"}, segments[0]):
+			id = segments[1]
+		}
+	}
+	if !youtubeVideoIdRegex.MatchString(id) {
+		return "", 0, false
+	}
+
+	// The start offset is given as t or start, in the query or the fragment
+	fragment, _ := url2.ParseQuery(u.Fragment)
+	for _, offset := range []string{query.Get("t"), query.Get("start"), fragment.Get("t")} {
+		if start, ok := parseYoutubeStart(offset); ok {
+			return id, start, true
+		}
+	}
+	return id, 0, true
+}
+
+// Parse a start offset such as 90, 90s or 1h2m30s into seconds
+func parseYoutubeStart(offset string) (int, bool) {
+	matches := youtubeStartRegex.FindStringSubmatch(offset)
+	if len(offset) == 0 || matches == nil {
+		return 0, false
+	}
+	seconds := 0
+	for i, unit := range []int{3600, 60, 1} {
+		if n, err := strconv.Atoi(matches[i+1]); err == nil {
+			seconds += n * unit
+		}
+	}
+	return seconds, seconds > 0
+}
+
+// The canonical watch url of a video, without tracking parameters. The start
+// offset is kept as t, which players that resolve the page url, such as mpv,
+// seek to.
+func youtubeVideoUrl(id string, start int) string {
+	videoUrl := "https://www.youtube.com/watch?v=" + id
+	if start > 0 {
+		videoUrl += "&t=" + strconv.Itoa(start) + "s"
+	}
+	return videoUrl
+}
+
+func (youtubeSource) Recurse(item PlaylistItem) (string, bool) {
+	return "", false
+}
+
+// The avatar and banners of the channel of a channel feed, from the channel page
+func (youtubeSource) Artwork(feedUrl string, info PlaylistInfo) (FolderArtwork, bool) {
+	matches := youtubeChannelFeedRegex.FindStringSubmatch(feedUrl)
+	if len(matches) == 0 {
+		return FolderArtwork{}, false
+	}
+	header := http.Header{"Cookie": {"CONSENT=YES+1"}}
+	body, err := client.get("https://www.youtube.com/channel/"+matches[1], header)
+	if err != nil {
+		slog.Warn("Could not fetch channel page for artwork", "channel", matches[1], "error", err)
+		return FolderArtwork{}, true
+	}
+	artwork := FolderArtwork{
+		poster: largestYoutubeImage(body, youtubeAvatarRegex),
+		banner: largestYoutubeImage(body, youtubeBannerRegex),
+		fanart: largestYoutubeImage(body, youtubeTvBannerRegex),
+	}
+	if len(artwork.fanart) == 0 {
+		artwork.fanart = artwork.banner
+	}
+	return artwork, true
+}
+
+// The last, and largest, image url in the thumbnail list matched by the regex
+func largestYoutubeImage(page []byte, re *regexp.Regexp) string {
+	matches := re.FindSubmatch(page)
+	if len(matches) == 0 {
+		return ""
+	}
+	urls := youtubeImageUrlRegex.FindAllSubmatch(matches[1], -1)
+	if len(urls) == 0 {
+		return ""
+	}
+	var url string
+	err := json.Unmarshal([]byte(`"`+string(urls[len(urls)-1][1])+`"`), &url)
+	if err != nil {
+		return ""
+	}
+	if strings.HasPrefix(url, "//") {
+		url = "https:" + url
+	}
+	return url
+}
+
+func youtubeStream(id, url string) Stream {
+	return Stream{id: id, url: url, strmUrl: "plugin://plugin.video.youtube/play/?video_id=" + id}
+}
+
+// Fetch a channel page, such as a handle, /c/ or /user/ url, and extract the canonical channel id
+func resolveYoutubeChannelID(channelUrl string) (string, error) {
+	// Skip the cookie consent interstitial served in some regions
+	header := http.Header{"Cookie": {"CONSENT=YES+1"}}
+	body, err := client.get(channelUrl, header)
+	if err != nil {
+		return "", err
+	}
+
+	for _, re := range youtubeChannelIdRegexes {
+		matches := re.FindSubmatch(body)
+		if len(matches) > 1 {
+			channelID := string(matches[1])
+			slog.Debug("Resolved channel id", "url", channelUrl, "channel", channelID)
+			return channelID, nil
+		}
+	}
+	return "", fmt.Errorf("no channel id found in %s", channelUrl)
+}
+
+func parseAndWriteChannelPlaylists(url string, channelID string, parseChannelPlaylists bool, title string, destinationDir string, prefix string, options Options) error {
+
+	parseVideos := true
+	slog.Debug("Parsing channel playlists", "title", title)
+
+	if parseChannelPlaylists || strings.Contains(options.sections, "p") { //playlists
+		playlistRegex := "\"playlistId\":\"(PL[a-zA-Z0-9_-]{16,32})\""
+		playlistsSection := "playlists"
+		playlistsExisted := parseAndWriteChannelPlaylistsForSection(channelID, destinationDir, prefix, title, playlistsSection, playlistRegex, options)
+		parseVideos = parseVideos && !playlistsExisted
+	}
+	if parseChannelPlaylists || strings.Contains(options.sections, "r") { //releases
+		releasesRegex := "\"playlistId\":\"(OL[a-zA-Z0-9_-]{39})\""
+		releasesSection := "releases"
+		releasesExisted := parseAndWriteChannelPlaylistsForSection(channelID, destinationDir, prefix, title, releasesSection, releasesRegex, options)
+		parseVideos = parseVideos && !releasesExisted
+	}
+
+	if parseVideos {
+		return parseAndWritePlaylists(title, fmt.Sprintf("https://www.youtube.com/feeds/videos.xml?channel_id=%s", channelID), destinationDir, prefix, options)
+	}
+	return nil
+}
+
+func parseAndWriteChannelPlaylistsForSection(channelID string, destinationDir string, prefix string, title string,
+	section string, playlistRegex string, options Options) bool {
+	playlistIds, err := getYoutubePlaylistsForChannel(channelID, section, playlistRegex)
+	if err != nil {
+		// Keep the playlists of the section as they are, since they could not be listed
+		sectionDir := destinationDir + "/" + prefix + "/" + playlistDirName(title) + "/" + section
+		produced.keepDir(sectionDir)
+		runReport.feed(sectionDir, "https://www.youtube.com/channel/"+channelID+"/"+section, statusFailed, 0, err)
+		return false
+	}
+	// The playlists of the section inherit the options of the channel entry
+	options.sections = ""
+	entries := make([]Entry, 0, len(playlistIds))
+	names := make(dirNames)
+	for _, playlistId := range playlistIds {
+		playlistName := getYoutubePlaylistName(playlistId)
+		if len(playlistName) < 1 {
+			playlistName = playlistId
+		}
+		playlistName = names.claim(playlistName, playlistId)
+		playlistURL := "https://www.youtube.com/playlist?list=" + playlistId
+		entries = append(entries, Entry{title: playlistName, url: playlistURL, options: options})
+	}
+	if len(entries) > 0 {
+		parsePlaylists(entries, destinationDir+"/"+prefix+"/"+playlistDirName(title), section, false)
+		return true
+	} else {
+		return false
+	}
+}
+
+func getYoutubePlaylistsForChannel(channelId string, section string, extractionRegex string) ([]string, error) {
+	re, err := regexp.Compile(extractionRegex)
+	if err != nil {
+		slog.Error("Error compiling regex", "regex", re, "error", err)
+		return nil, err
+	}
+
+	channelPlaylistsUrl := "https://www.youtube.com/channel/" + channelId + "/" + section
+	body, err := client.get(channelPlaylistsUrl, nil)
+	if err != nil {
+		slog.Error("Error fetching URL", "url", channelPlaylistsUrl, "error", err)
+		return nil, err
+	}
+
+	var playlistIds []string
+	matches := re.FindAllStringSubmatch(string(body), -1)
+	for _, match := range matches {
+		if len(match) > 1 {
+			playlistIds = append(playlistIds, match[1])
+		}
+	}
+
+	slices.Sort(playlistIds)
+	return slices.Compact(playlistIds), nil
+}
+
+func getYoutubePlaylistName(playlistId string) string {
+	titleRegex := "<title>(.*?)(?:- YouTube)?</title>"
+	re, err := regexp.Compile(titleRegex)
+	if err != nil {
+		slog.Error("Error compiling regex", "regex", re, "error", err)
+		return ""
+	}
+
+	playlistUrl := "https://www.youtube.com/playlist?list=" + playlistId
+	body, err := client.get(playlistUrl, nil)
+	if err != nil {
+		slog.Error("Error fetching URL", "url", playlistUrl, "error", err)
+		return ""
+	}
+
+	matches := re.FindAllStringSubmatch(string(body), -1)
+	for _, match := range matches {
+		if len(match) > 1 {
+			return html.UnescapeString(match[1])
+		} else {
+			slog.Error("Could not find title match for playlist", "url", playlistUrl)
+		}
+	}
+	slog.Error("Could not find title match for playlist, returning", "url", playlistUrl)
+	return ""
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mmcdole/gofeed"
+)
+
+func TestParseYoutubeVideoUrl(t *testing.T) {
+	tests := []struct {
+		link  string
+		id    string
+		start int
+		ok    bool
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ", 0, true},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&feature=share&si=abc", "dQw4w9WgXcQ", 0, true},
+		{"https://youtube.com/watch?v=dQw4w9WgXcQ", "dQw4w9WgXcQ", 0, true},
+		{"https://m.youtube.com/watch?v=dQw4w9WgXcQ&t=1m5s", "dQw4w9WgXcQ", 65, true},
+		{"https://music.youtube.com/watch?v=dQw4w9WgXcQ&list=RDdQw4w9WgXcQ", "dQw4w9WgXcQ", 0, true},
+		{"https://youtube.com/shorts/dQw4w9WgXcQ?si=x", "dQw4w9WgXcQ", 0, true},
+		{"https://www.youtube.com/live/dQw4w9WgXcQ?t=90", "dQw4w9WgXcQ", 90, true},
+		{"https://www.youtube.com/embed/dQw4w9WgXcQ", "dQw4w9WgXcQ", 0, true},
+		{"https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ?start=30", "dQw4w9WgXcQ", 30, true},
+		{"https://youtu.be/dQw4w9WgXcQ?t=42", "dQw4w9WgXcQ", 42, true},
+		{"https://youtu.be/dQw4w9WgXcQ?si=tracking", "dQw4w9WgXcQ", 0, true},
+		{"//www.youtube.com/embed/dQw4w9WgXcQ", "dQw4w9WgXcQ", 0, true},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ#t=1h", "dQw4w9WgXcQ", 3600, true},
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=junk", "dQw4w9WgXcQ", 0, true},
+		{"https://www.youtube.com/watch?v=short", "", 0, false},
+		{"https://www.youtube.com/channel/UCuAXFkgsw1L7xaCfnd5JJOw", "", 0, false},
+		{"https://www.youtube.com/playlist?list=PL590L5WQmH8fJ54F369BLDSqIwcs-TCfs", "", 0, false},
+		{"https://notyoutube.com/watch?v=dQw4w9WgXcQ", "", 0, false},
+		{"https://example.com/shorts/dQw4w9WgXcQ", "", 0, false},
+	}
+	for _, test := range tests {
+		id, start, ok := parseYoutubeVideoUrl(test.link)
+		if id != test.id || start != test.start || ok != test.ok {
+			t.Errorf("parseYoutubeVideoUrl(%q) = %q, %d, %v, want %q, %d, %v", test.link, id, start, ok, test.id, test.start, test.ok)
+		}
+	}
+}
+
+func TestParseYoutubeStart(t *testing.T) {
+	tests := []struct {
+		offset  string
+		seconds int
+		ok      bool
+	}{
+		{"90", 90, true},
+		{"90s", 90, true},
+		{"1m30s", 90, true},
+		{"1h2m3s", 3723, true},
+		{"2m", 120, true},
+		{"0", 0, false},
+		{"", 0, false},
+		{"abc", 0, false},
+		{"1x", 0, false},
+	}
+	for _, test := range tests {
+		seconds, ok := parseYoutubeStart(test.offset)
+		if seconds != test.seconds || ok != test.ok {
+			t.Errorf("parseYoutubeStart(%q) = %d, %v, want %d, %v", test.offset, seconds, ok, test.seconds, test.ok)
+		}
+	}
+}
+
+func TestYoutubeVideoUrl(t *testing.T) {
+	if got := youtubeVideoUrl("dQw4w9WgXcQ", 0); got != "https://www.youtube.com/watch?v=dQw4w9WgXcQ" {
+		t.Errorf("youtubeVideoUrl without start = %q", got)
+	}
+	if got := youtubeVideoUrl("dQw4w9WgXcQ", 65); got != "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=65s" {
+		t.Errorf("youtubeVideoUrl with start = %q", got)
+	}
+}
+
+func TestStreamForItem(t *testing.T) {
+	tests := []struct {
+		name   string
+		item   gofeed.Item
+		source string
+		url    string
+	}{
+		{"youtube link", gofeed.Item{Link: "https://www.youtube.com/shorts/dQw4w9WgXcQ"},
+			"youtube", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"link in content", gofeed.Item{Link: "https://www.reddit.com/r/videos/comments/x", Content: `<a href="https://m.youtube.com/watch?v=dQw4w9WgXcQ&amp;t=10s">video</a>`},
+			"youtube", "https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=10s"},
+		{"punctuation after link in content", gofeed.Item{Link: "https://www.reddit.com/r/videos/comments/x", Content: "watch (https://youtu.be/dQw4w9WgXcQ)."},
+			"youtube", "https://www.youtube.com/watch?v=dQw4w9WgXcQ"},
+		{"enclosure before link in content", gofeed.Item{Link: "https://pod.example/ep1", Content: "see https://youtu.be/dQw4w9WgXcQ",
+			Enclosures: []*gofeed.Enclosure{{URL: "https://pod.example/ep1.mp3", Type: "audio/mpeg"}}},
+			"enclosure", "https://pod.example/ep1.mp3"},
+	}
+	for _, test := range tests {
+		source, stream, ok := streamForItem(&test.item)
+		if !ok {
+			t.Errorf("%s: no stream", test.name)
+			continue
+		}
+		if source.Name() != test.source || stream.url != test.url {
+			t.Errorf("%s: got %s %s, want %s %s", test.name, source.Name(), stream.url, test.source, test.url)
+		}
+	}
+}